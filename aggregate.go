@@ -0,0 +1,172 @@
+package meter
+
+// Aggregate is the value of each step of a series returned by a query
+type Aggregate uint8
+
+// Aggregates
+const (
+	CountAggregate Aggregate = iota
+	SumAggregate
+	AvgAggregate
+	MinAggregate
+	MaxAggregate
+	LastAggregate
+)
+
+// AggregateFromString converts a string to Aggregate
+func AggregateFromString(s string) Aggregate {
+	switch s {
+	case "sum":
+		return SumAggregate
+	case "avg":
+		return AvgAggregate
+	case "min":
+		return MinAggregate
+	case "max":
+		return MaxAggregate
+	case "last":
+		return LastAggregate
+	default:
+		return CountAggregate
+	}
+}
+
+func (a Aggregate) String() string {
+	switch a {
+	case SumAggregate:
+		return "sum"
+	case AvgAggregate:
+		return "avg"
+	case MinAggregate:
+		return "min"
+	case MaxAggregate:
+		return "max"
+	case LastAggregate:
+		return "last"
+	default:
+		return "count"
+	}
+}
+
+// aggregates accumulates scan items
+type aggregates struct {
+	count    int64
+	sum      float64
+	min      float64
+	max      float64
+	last     float64
+	lastTime int64
+}
+
+func (a *aggregates) add(item *ScanItem) {
+	a.sum += item.Sum
+	if item.Count == 0 {
+		return
+	}
+	if a.count == 0 {
+		a.min, a.max = item.Min, item.Max
+	} else {
+		if item.Min < a.min {
+			a.min = item.Min
+		}
+		if item.Max > a.max {
+			a.max = item.Max
+		}
+	}
+	if a.count == 0 || item.Time >= a.lastTime {
+		a.last, a.lastTime = item.Last, item.Time
+	}
+	a.count += item.Count
+}
+
+func (a *aggregates) value(agg Aggregate) float64 {
+	switch agg {
+	case SumAggregate:
+		return a.sum
+	case AvgAggregate:
+		if a.count == 0 {
+			return 0
+		}
+		return a.sum / float64(a.count)
+	case MinAggregate:
+		return a.min
+	case MaxAggregate:
+		return a.max
+	case LastAggregate:
+		return a.last
+	default:
+		return float64(a.count)
+	}
+}
+
+type aggregatePoint struct {
+	aggregates
+	ts int64
+}
+
+type aggregateSeries struct {
+	event  string
+	fields Fields
+	total  aggregates
+	data   []aggregatePoint
+}
+
+func (s *aggregateSeries) add(item *ScanItem, ts int64) {
+	s.total.add(item)
+	for i := len(s.data) - 1; 0 <= i && i < len(s.data); i-- {
+		d := &s.data[i]
+		if d.ts == ts {
+			d.add(item)
+			return
+		}
+	}
+	s.data = append(s.data, aggregatePoint{ts: ts})
+	s.data[len(s.data)-1].add(item)
+}
+
+// aggregateResults accumulates scan items to Results
+type aggregateResults []aggregateSeries
+
+func (series aggregateResults) add(event string, item *ScanItem, ts int64) aggregateResults {
+	for i := range series {
+		s := &series[i]
+		if s.event == event && s.fields.Equal(item.Fields) {
+			s.add(item, ts)
+			return series
+		}
+	}
+	series = append(series, aggregateSeries{
+		event:  event,
+		fields: item.Fields,
+	})
+	series[len(series)-1].add(item, ts)
+	return series
+}
+
+// Results converts accumulated series to Results using agg for each step
+func (series aggregateResults) Results(agg Aggregate) Results {
+	results := make(Results, 0, len(series))
+	for i := range series {
+		s := &series[i]
+		r := Result{
+			Event:     s.event,
+			Fields:    s.fields,
+			Total:     s.total.count,
+			Aggregate: s.total.value(agg),
+			Data:      make([]DataPoint, 0, len(s.data)),
+		}
+		for j := range s.data {
+			d := &s.data[j]
+			if d.count == 0 && agg != CountAggregate {
+				continue
+			}
+			r.Data = append(r.Data, DataPoint{
+				Timestamp: d.ts,
+				Value:     d.count,
+				Aggregate: d.value(agg),
+			})
+		}
+		results = append(results, r)
+	}
+	return results
+}
@@ -0,0 +1,288 @@
+package meter
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Scopes of auth tokens
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+	ScopeDebug = "debug"
+)
+
+// Token is an auth token
+type Token struct {
+	// Name identifies the token in signed requests
+	Name string `json:"name"`
+	// Secret is the bearer token and the key of signed requests
+	Secret string `json:"secret"`
+	// Scopes are the allowed scopes of the token
+	Scopes []string `json:"scopes"`
+	// Events limits the token to specific events, empty allows all events
+	Events []string `json:"events,omitempty"`
+}
+
+// Allow checks if a token allows scope for event
+//
+// An empty event checks only the scope.
+func (t *Token) Allow(scope, event string) bool {
+	if indexOf(t.Scopes, scope) == -1 {
+		return false
+	}
+	return event == "" || len(t.Events) == 0 || indexOf(t.Events, event) != -1
+}
+
+type tokenContextKey struct{}
+
+// ContextWithToken returns a copy of ctx carrying an authenticated token
+func ContextWithToken(ctx context.Context, t *Token) context.Context {
+	return context.WithValue(ctx, tokenContextKey{}, t)
+}
+
+// TokenFromContext returns the authenticated token of ctx
+//
+// Handlers check event scopes only for requests with a token.
+func TokenFromContext(ctx context.Context) *Token {
+	t, _ := ctx.Value(tokenContextKey{}).(*Token)
+	return t
+}
+
+// allow checks if the token of ctx allows scope for event
+func allow(ctx context.Context, scope, event string) bool {
+	if t := TokenFromContext(ctx); t != nil {
+		return t.Allow(scope, event)
+	}
+	return true
+}
+
+// Authenticator authenticates HTTP requests
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Token, error)
+}
+
+// RequireAuth middleware authenticates requests and checks their token allows scope
+//
+// The authenticated token is added to the request context so handlers can check event scopes.
+func RequireAuth(auth Authenticator, scope string, next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t, err := auth.Authenticate(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="meter"`)
+			code := http.StatusUnauthorized
+			http.Error(w, http.StatusText(code), code)
+			return
+		}
+		if !t.Allow(scope, "") {
+			code := http.StatusForbidden
+			http.Error(w, http.StatusText(code), code)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(ContextWithToken(r.Context(), t)))
+	}
+}
+
+// Auth headers
+const (
+	// AuthSchemeHMAC is the Authorization scheme of signed requests
+	AuthSchemeHMAC = "HMAC-SHA256"
+	// HeaderTimestamp is the header with the Unix time of signed requests
+	HeaderTimestamp = "X-Meter-Timestamp"
+)
+
+// DefaultMaxSkew is the default max clock skew of signed requests
+const DefaultMaxSkew = 5 * time.Minute
+
+var errUnauthorized = errors.New("Unauthorized")
+
+// TokenAuth authenticates requests with tokens loaded from a JSON file
+//
+// Requests are authenticated either with a bearer token
+//
+//	Authorization: Bearer <secret>
+//
+// where the Token scheme of InfluxDB clients is also accepted,
+// or with an HMAC-SHA256 signature of the method, URI, timestamp and body
+//
+//	Authorization: HMAC-SHA256 <name>:<hex signature>
+//	X-Meter-Timestamp: <unix time>
+type TokenAuth struct {
+	// Filename is the JSON file with an array of tokens
+	Filename string
+	// MaxSkew is the max clock skew of signed requests, defaults to DefaultMaxSkew
+	MaxSkew time.Duration
+	// MaxBodySize is the max body size of signed requests, zero means no limit
+	MaxBodySize int64
+
+	mu       sync.RWMutex
+	bySecret map[[sha256.Size]byte]*Token
+	byName   map[string]*Token
+}
+
+// LoadTokenAuth creates a TokenAuth loading tokens from a file
+func LoadTokenAuth(filename string) (*TokenAuth, error) {
+	a := TokenAuth{
+		Filename: filename,
+	}
+	if err := a.Reload(); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// Reload reloads tokens from the file
+//
+// Tokens are replaced only if the whole file is valid.
+func (a *TokenAuth) Reload() error {
+	data, err := ioutil.ReadFile(a.Filename)
+	if err != nil {
+		return err
+	}
+	var tokens []Token
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return err
+	}
+	return a.SetTokens(tokens...)
+}
+
+// SetTokens replaces all tokens
+func (a *TokenAuth) SetTokens(tokens ...Token) error {
+	bySecret := make(map[[sha256.Size]byte]*Token, len(tokens))
+	byName := make(map[string]*Token, len(tokens))
+	for i := range tokens {
+		t := &tokens[i]
+		if t.Secret == "" {
+			return errors.New("Token without secret")
+		}
+		if t.Name != "" {
+			if _, duplicate := byName[t.Name]; duplicate {
+				return errors.New("Duplicate token " + strconv.Quote(t.Name))
+			}
+			byName[t.Name] = t
+		}
+		bySecret[sha256.Sum256([]byte(t.Secret))] = t
+	}
+	a.mu.Lock()
+	a.bySecret, a.byName = bySecret, byName
+	a.mu.Unlock()
+	return nil
+}
+
+// Authenticate implements Authenticator interface
+func (a *TokenAuth) Authenticate(r *http.Request) (*Token, error) {
+	auth := r.Header.Get("Authorization")
+	scheme, credentials := auth, ""
+	if i := strings.IndexByte(auth, ' '); i != -1 {
+		scheme, credentials = auth[:i], strings.TrimSpace(auth[i+1:])
+	}
+	switch {
+	case strings.EqualFold(scheme, "Bearer"), strings.EqualFold(scheme, "Token"):
+		a.mu.RLock()
+		t := a.bySecret[sha256.Sum256([]byte(credentials))]
+		a.mu.RUnlock()
+		if t == nil {
+			return nil, errUnauthorized
+		}
+		return t, nil
+	case scheme == AuthSchemeHMAC:
+		return a.authenticateHMAC(r, credentials)
+	default:
+		return nil, errUnauthorized
+	}
+}
+
+func (a *TokenAuth) authenticateHMAC(r *http.Request, credentials string) (*Token, error) {
+	i := strings.IndexByte(credentials, ':')
+	if i == -1 {
+		return nil, errUnauthorized
+	}
+	name, sig := credentials[:i], credentials[i+1:]
+	a.mu.RLock()
+	t := a.byName[name]
+	a.mu.RUnlock()
+	if t == nil {
+		return nil, errUnauthorized
+	}
+	ts := r.Header.Get(HeaderTimestamp)
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return nil, errUnauthorized
+	}
+	maxSkew := a.MaxSkew
+	if maxSkew <= 0 {
+		maxSkew = DefaultMaxSkew
+	}
+	if skew := time.Since(time.Unix(sec, 0)); skew > maxSkew || skew < -maxSkew {
+		return nil, errUnauthorized
+	}
+	var body []byte
+	if r.Body != nil {
+		rd := r.Body
+		if a.MaxBodySize > 0 {
+			rd = http.MaxBytesReader(nil, rd, a.MaxBodySize)
+		}
+		body, err = ioutil.ReadAll(rd)
+		r.Body.Close()
+		if err != nil {
+			return nil, errUnauthorized
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	want := signRequest(t.Secret, r.Method, r.URL.RequestURI(), ts, body)
+	got, err := hex.DecodeString(sig)
+	if err != nil || !hmac.Equal(got, want) {
+		return nil, errUnauthorized
+	}
+	return t, nil
+}
+
+func signRequest(secret, method, uri, ts string, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(method))
+	mac.Write([]byte{'\n'})
+	mac.Write([]byte(uri))
+	mac.Write([]byte{'\n'})
+	mac.Write([]byte(ts))
+	mac.Write([]byte{'\n'})
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// ClientAuth authenticates client requests
+type ClientAuth interface {
+	AuthenticateRequest(r *http.Request, body []byte)
+}
+
+// BearerAuth authenticates client requests with a bearer token
+type BearerAuth string
+
+// AuthenticateRequest implements ClientAuth interface
+func (token BearerAuth) AuthenticateRequest(r *http.Request, _ []byte) {
+	r.Header.Set("Authorization", "Bearer "+string(token))
+}
+
+// HMACAuth authenticates client requests by signing them with a token secret
+type HMACAuth struct {
+	Name   string
+	Secret string
+}
+
+// AuthenticateRequest implements ClientAuth interface
+func (a *HMACAuth) AuthenticateRequest(r *http.Request, body []byte) {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	sig := signRequest(a.Secret, r.Method, r.URL.RequestURI(), ts, body)
+	r.Header.Set(HeaderTimestamp, ts)
+	r.Header.Set("Authorization", AuthSchemeHMAC+" "+a.Name+":"+hex.EncodeToString(sig))
+}
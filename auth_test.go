@@ -0,0 +1,89 @@
+package meter_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	meter "github.com/alxarch/go-meter/v2"
+)
+
+func TestTokenAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "meter-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "tokens.json")
+	writeTokens := func(data string) {
+		if err := ioutil.WriteFile(filename, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeTokens(`[
+		{"name": "writer", "secret": "w1", "scopes": ["write"], "events": ["foo"]},
+		{"name": "reader", "secret": "r1", "scopes": ["read"]}
+	]`)
+	auth, err := meter.LoadTokenAuth(filename)
+	AssertNil(t, err)
+
+	db := &testStore{}
+	mux := http.NewServeMux()
+	mux.Handle("/events", meter.RequireAuth(auth, meter.ScopeWrite, meter.StoreHandler(db)))
+	mux.Handle("/query", meter.RequireAuth(auth, meter.ScopeRead, meter.QueryHandler(meter.ScanQueryRunner(&meter.MemoryStore{Event: "foo"}))))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	req := func(event string) *meter.StoreRequest {
+		return &meter.StoreRequest{
+			Event:    event,
+			Time:     time.Now(),
+			Labels:   []string{"color"},
+			Counters: meter.Snapshot{{Values: []string{"blue"}, Count: 1}},
+		}
+	}
+	s := &meter.HTTPStore{URL: srv.URL + "/events"}
+	Assert(t, s.Store(req("foo")) != nil, "Unauthenticated request stored")
+	s.Auth = meter.BearerAuth("w1")
+	AssertNil(t, s.Store(req("foo")))
+	Assert(t, s.Store(req("bar")) != nil, "Forbidden event stored")
+	s.Auth = &meter.HMACAuth{Name: "writer", Secret: "w1"}
+	AssertNil(t, s.Store(req("foo")))
+	s.Binary = true
+	AssertNil(t, s.Store(req("foo")))
+	s.Auth = &meter.HMACAuth{Name: "writer", Secret: "wrong"}
+	Assert(t, s.Store(req("foo")) != nil, "Invalid signature stored")
+	s.Auth = meter.BearerAuth("r1")
+	Assert(t, s.Store(req("foo")) != nil, "Read token stored")
+	AssertEqual(t, len(db.data), 3)
+
+	ctx := context.Background()
+	q := meter.Query{TimeRange: meter.TimeRange{Start: time.Now().Add(-time.Hour), End: time.Now()}}
+	qr := &meter.HTTPQueryRunner{URL: srv.URL + "/query"}
+	_, err = qr.RunQuery(ctx, &q, "foo")
+	Assert(t, err != nil, "Unauthenticated query")
+	qr.Auth = &meter.HMACAuth{Name: "reader", Secret: "r1"}
+	_, err = qr.RunQuery(ctx, &q, "foo")
+	AssertNil(t, err)
+
+	// Rotate tokens
+	writeTokens(`[{"name": "reader", "secret": "r2", "scopes": ["read"], "events": ["bar"]}]`)
+	AssertNil(t, auth.Reload())
+	_, err = qr.RunQuery(ctx, &q, "foo")
+	Assert(t, err != nil, "Rotated token accepted")
+	qr.Auth = meter.BearerAuth("r2")
+	_, err = qr.RunQuery(ctx, &q, "foo")
+	Assert(t, err != nil, "Forbidden event queried")
+	_, err = qr.RunQuery(ctx, &q, "bar")
+	AssertNil(t, err)
+
+	writeTokens(`[{"name": "broken"}]`)
+	Assert(t, auth.Reload() != nil, "Invalid tokens loaded")
+	_, err = qr.RunQuery(ctx, &q, "bar")
+	AssertNil(t, err)
+}
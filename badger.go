@@ -6,6 +6,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"math"
 	"sort"
 	"sync"
 	"time"
@@ -27,8 +28,9 @@ func Open(db *badger.DB, events ...string) (BadgerEvents, error) {
 	for i, event := range events {
 		id := eventIDs[i]
 		store[event] = &badgerEvent{
-			DB: db,
-			id: eventID(id),
+			DB:        db,
+			id:        eventID(id),
+			retention: DefaultRequestRetention,
 		}
 	}
 
@@ -41,7 +43,17 @@ func (store BadgerEvents) Store(s *StoreRequest) error {
 	if e == nil {
 		return errMissingEvent(s.Event)
 	}
-	return e.store(s.Time.Unix(), s.Labels, s.Counters)
+	return e.store(s.ID, s.Time.Unix(), s.Kind, s.Labels, s.Counters)
+}
+
+// DefaultRequestRetention is the default time request IDs are kept to detect duplicates
+const DefaultRequestRetention = 24 * time.Hour
+
+// SetRequestRetention sets the time request IDs are kept to detect duplicates
+func (store BadgerEvents) SetRequestRetention(d time.Duration) {
+	for _, e := range store {
+		e.retention = d
+	}
 }
 
 // Scanner implements Scanners interface
@@ -54,8 +66,9 @@ func (store BadgerEvents) Scanner(event string) Scanner {
 
 type badgerEvent struct {
 	*badger.DB
-	id     eventID
-	fields FieldCache
+	id        eventID
+	fields    FieldCache
+	retention time.Duration
 }
 
 const (
@@ -63,20 +76,58 @@ const (
 	keyVersion      = 0
 	prefixByteValue = 1
 	prefixByteEvent = 2
+	// Request keys are variable size, the request ID follows the event id
+	prefixByteRequest = 3
 )
 
+// Entry layouts of event values are stored in the reserved bytes of event keys
+const (
+	// id, count
+	layoutCounter byte = iota
+	// id, count, sum, min, max, last
+	layoutGauge
+	// id, count, sum
+	layoutSum
+)
+
+var entryLayouts = []byte{layoutCounter, layoutGauge, layoutSum}
+
+func layoutOf(kind Kind, counters Snapshot) byte {
+	if kind == GaugeKind {
+		return layoutGauge
+	}
+	for i := range counters {
+		if counters[i].Sum != 0 {
+			return layoutSum
+		}
+	}
+	return layoutCounter
+}
+
+func entrySize(layout byte) int {
+	switch layout {
+	case layoutGauge:
+		return 48
+	case layoutSum:
+		return 24
+	default:
+		return 16
+	}
+}
+
 type keyBuffer [keySize]byte
 
 type eventID uint32
 
-func eventKeyAt(event eventID, tm time.Time) (k keyBuffer) {
-	return eventKey(event, tm.Unix())
+func eventKeyAt(event eventID, layout byte, tm time.Time) (k keyBuffer) {
+	return eventKey(event, layout, tm.Unix())
 }
 
-func eventKey(event eventID, ts int64) (k keyBuffer) {
+func eventKey(event eventID, layout byte, ts int64) (k keyBuffer) {
 	k[0] = keyVersion
 	k[1] = prefixByteEvent
 	binary.BigEndian.PutUint32(k[2:], uint32(event))
+	k[6] = layout
 	binary.BigEndian.PutUint64(k[8:], uint64(ts))
 	return k
 }
@@ -89,9 +140,24 @@ func valueKey(event eventID, id uint64) (k keyBuffer) {
 	return k
 }
 
-func parseEventKey(e eventID, k []byte) (int64, bool) {
+func parseEventKey(e eventID, layout byte, k []byte) (int64, bool) {
 	p, event, id := parseKey(k)
-	return int64(id), p == prefixByteEvent && e == event
+	return int64(id), p == prefixByteEvent && e == event && keyLayout(k) == layout
+}
+
+func keyLayout(k []byte) byte {
+	if len(k) == keySize {
+		return k[6]
+	}
+	return 0
+}
+
+func requestKey(event eventID, id string) []byte {
+	k := make([]byte, 6, 6+len(id))
+	k[0] = keyVersion
+	k[1] = prefixByteRequest
+	binary.BigEndian.PutUint32(k[2:], uint32(event))
+	return append(k, id...)
 }
 
 func parseValueKey(e eventID, k []byte) (uint64, bool) {
@@ -106,8 +172,8 @@ func parseKey(k []byte) (byte, eventID, uint64) {
 	return 0, 0, 0
 }
 
-func seekEvent(iter *badger.Iterator, event eventID, tm time.Time) {
-	key := eventKey(event, tm.Unix())
+func seekEvent(iter *badger.Iterator, event eventID, layout byte, tm time.Time) {
+	key := eventKeyAt(event, layout, tm)
 	iter.Seek(key[:])
 }
 
@@ -120,13 +186,13 @@ func (b *badgerEvent) Labels() ([]string, error) {
 	return b.fields.Labels(), nil
 }
 
-func (b *badgerEvent) store(ts int64, labels []string, counters Snapshot) (err error) {
+func (b *badgerEvent) store(reqID string, ts int64, kind Kind, labels []string, counters Snapshot) (err error) {
 	var (
-		cache   = &b.fields
-		index   = newLabelIndex(labels...)
-		scratch [16]byte
-		value   = getBuffer()[:0]
-		buf     = getBuffer()[:0]
+		cache  = &b.fields
+		index  = newLabelIndex(labels...)
+		layout = layoutOf(kind, counters)
+		value  = getBuffer()[:0]
+		buf    = getBuffer()[:0]
 	)
 	for i := range counters {
 		c := &counters[i]
@@ -141,19 +207,29 @@ func (b *badgerEvent) store(ts int64, labels []string, counters Snapshot) (err e
 			}
 			cache.SetRaw(id, buf)
 		}
-		binary.BigEndian.PutUint64(scratch[:], id)
-		binary.BigEndian.PutUint64(scratch[8:], uint64(c.Count))
-		value = append(value, scratch[:]...)
+		entry := compactionEntry{
+			id:   id,
+			n:    c.Count,
+			sum:  c.Sum,
+			min:  c.Min,
+			max:  c.Max,
+			last: c.Last,
+		}
+		value = entry.AppendTo(value, layout)
+	}
+	key := eventKey(b.id, layout, ts)
+	var reqKey []byte
+	if reqID != "" {
+		reqKey = requestKey(b.id, reqID)
 	}
-	key := eventKey(b.id, ts)
 
 retry:
-	if err = store(b.DB, key[:], value); err == badger.ErrConflict {
+	if err = store(b.DB, key[:], value, reqKey, b.retention); err == badger.ErrConflict {
 		goto retry
 	}
 	putBuffer(value)
 	putBuffer(buf)
-	return nil
+	return err
 }
 
 func (b *badgerEvent) loadID(data []byte) (id uint64, err error) {
@@ -203,9 +279,29 @@ func (b *badgerEvent) loadID(data []byte) (id uint64, err error) {
 	return
 }
 
-func store(db *badger.DB, key, value []byte) error {
+// store appends value to key
+//
+// If reqKey is not nil it is stored in the same transaction for ttl
+// and ErrDuplicate is returned if it already exists.
+func store(db *badger.DB, key, value, reqKey []byte, ttl time.Duration) error {
 	txn := db.NewTransaction(true)
 	defer txn.Discard()
+	if reqKey != nil {
+		switch _, err := txn.Get(reqKey); err {
+		case nil:
+			return ErrDuplicate
+		case badger.ErrKeyNotFound:
+			e := badger.NewEntry(reqKey, nil)
+			if ttl > 0 {
+				e = e.WithTTL(ttl)
+			}
+			if err := txn.SetEntry(e); err != nil {
+				return err
+			}
+		default:
+			return err
+		}
+	}
 	item, err := txn.Get(key)
 	switch err {
 	case badger.ErrKeyNotFound:
@@ -242,10 +338,14 @@ func DumpKeys(db *badger.DB, w io.Writer) error {
 				fmt.Fprintf(w, "v event %d field %d value %v\n", event, id, fields)
 			case prefixByteEvent:
 				item.Value(func(v []byte) error {
-					fmt.Fprintf(w, "e event %d field %d size %d\n", event, id, len(v)/16)
+					fmt.Fprintf(w, "e event %d field %d size %d\n", event, id, len(v)/entrySize(keyLayout(key)))
 					return nil
 				})
 			default:
+				if len(key) > 6 && key[1] == prefixByteRequest {
+					fmt.Fprintf(w, "r event %d id %q\n", binary.BigEndian.Uint32(key[2:]), key[6:])
+					continue
+				}
 				fmt.Fprintf(w, "? %x\n", key)
 			}
 		}
@@ -305,12 +405,13 @@ func (b *badgerEvent) query(ctx context.Context, q *Query, items chan<- ScanItem
 			queryFields[id] = fields
 			return fields, nil
 		}
+		layout    byte
 		batch     []ScanItem
 		scanValue = func(value []byte) error {
-			var id, n uint64
-			for len(value) >= 16 {
-				id, n, value = binary.BigEndian.Uint64(value), binary.BigEndian.Uint64(value[8:]), value[16:]
-				fields, err := resolve(id)
+			size := entrySize(layout)
+			for ; len(value) >= size; value = value[size:] {
+				e := readEntry(value, layout)
+				fields, err := resolve(e.id)
 				if err != nil {
 					return err
 				}
@@ -319,7 +420,11 @@ func (b *badgerEvent) query(ctx context.Context, q *Query, items chan<- ScanItem
 				}
 				batch = append(batch, ScanItem{
 					Fields: fields,
-					Count:  int64(n),
+					Count:  e.n,
+					Sum:    e.sum,
+					Min:    e.min,
+					Max:    e.max,
+					Last:   e.last,
 				})
 			}
 			return nil
@@ -330,12 +435,18 @@ func (b *badgerEvent) query(ctx context.Context, q *Query, items chan<- ScanItem
 	defer txn.Discard()
 	iter := txn.NewIterator(badger.DefaultIteratorOptions)
 	defer iter.Close()
-	seekEvent(iter, b.id, q.Start)
-	for ; iter.Valid(); iter.Next() {
-		item := iter.Item()
-		key := item.Key()
-		ts, ok := parseEventKey(b.id, key)
-		if ok && minT <= ts && ts < maxT {
+	for _, layout = range entryLayouts {
+		seekEvent(iter, b.id, layout, q.Start)
+		for ; iter.Valid(); iter.Next() {
+			item := iter.Item()
+			key := item.Key()
+			ts, ok := parseEventKey(b.id, layout, key)
+			if !ok || ts >= maxT {
+				break
+			}
+			if ts < minT {
+				continue
+			}
 			batch = batch[:0]
 			err := item.Value(scanValue)
 			if err != nil {
@@ -397,7 +508,12 @@ func (store BadgerEvents) Compaction(now time.Time) error {
 		}
 		go func() {
 			defer wg.Done()
-			errc <- compactionScan(db, b.id, now)
+			for _, layout := range entryLayouts {
+				if err := compactionScan(db, b.id, layout, now); err != nil {
+					errc <- err
+					return
+				}
+			}
 		}()
 	}
 	wg.Wait()
@@ -410,12 +526,70 @@ func (store BadgerEvents) Compaction(now time.Time) error {
 	if gc == nil {
 		return nil
 	}
-	return gc.RunValueLogGC(0.5)
+	if err := gc.RunValueLogGC(0.5); err != badger.ErrNoRewrite {
+		return err
+	}
+	return nil
 }
 
 type compactionEntry struct {
-	id uint64
-	n  int64
+	id   uint64
+	n    int64
+	sum  float64
+	min  float64
+	max  float64
+	last float64
+}
+
+func readEntry(value []byte, layout byte) (e compactionEntry) {
+	e.id = binary.BigEndian.Uint64(value)
+	e.n = int64(binary.BigEndian.Uint64(value[8:]))
+	switch layout {
+	case layoutSum:
+		e.sum = math.Float64frombits(binary.BigEndian.Uint64(value[16:]))
+	case layoutGauge:
+		e.sum = math.Float64frombits(binary.BigEndian.Uint64(value[16:]))
+		e.min = math.Float64frombits(binary.BigEndian.Uint64(value[24:]))
+		e.max = math.Float64frombits(binary.BigEndian.Uint64(value[32:]))
+		e.last = math.Float64frombits(binary.BigEndian.Uint64(value[40:]))
+	}
+	return
+}
+
+// AppendTo appends the entry in the specified layout
+func (e *compactionEntry) AppendTo(out []byte, layout byte) []byte {
+	out = appendUint64(out, e.id)
+	out = appendUint64(out, uint64(e.n))
+	switch layout {
+	case layoutSum:
+		out = appendUint64(out, math.Float64bits(e.sum))
+	case layoutGauge:
+		out = appendUint64(out, math.Float64bits(e.sum))
+		out = appendUint64(out, math.Float64bits(e.min))
+		out = appendUint64(out, math.Float64bits(e.max))
+		out = appendUint64(out, math.Float64bits(e.last))
+	}
+	return out
+}
+
+// merge merges a later entry
+func (e *compactionEntry) merge(other *compactionEntry) {
+	e.sum += other.sum
+	if other.n == 0 {
+		return
+	}
+	if e.n == 0 {
+		e.min, e.max = other.min, other.max
+	} else {
+		if other.min < e.min {
+			e.min = other.min
+		}
+		if other.max > e.max {
+			e.max = other.max
+		}
+	}
+	e.n += other.n
+	e.last = other.last
 }
 
 type compactionBuffer []compactionEntry
@@ -431,11 +605,10 @@ func (cc compactionBuffer) Less(i, j int) bool {
 	return cc[i].id < cc[j].id
 }
 
-func (cc compactionBuffer) Read(value []byte) compactionBuffer {
-	for tail := value; len(tail) >= 16; tail = tail[16:] {
-		id := binary.BigEndian.Uint64(tail)
-		n := int64(binary.BigEndian.Uint64(tail[8:]))
-		cc = append(cc, compactionEntry{id, n})
+func (cc compactionBuffer) Read(value []byte, layout byte) compactionBuffer {
+	size := entrySize(layout)
+	for tail := value; len(tail) >= size; tail = tail[size:] {
+		cc = append(cc, readEntry(tail, layout))
 	}
 	return cc
 }
@@ -454,16 +627,15 @@ func putCompactionBuffer(cc compactionBuffer) {
 }
 
 func (cc compactionBuffer) Compact() compactionBuffer {
-	sort.Sort(cc)
-	var last *compactionEntry
+	// Entries are read in time order so a stable sort keeps the last values last
+	sort.Stable(cc)
 	j := 0
 	for i := range cc {
 		c := &cc[i]
-		if last != nil && last.id == c.id {
-			last.n += c.n
+		if j > 0 && cc[j-1].id == c.id {
+			cc[j-1].merge(c)
 			continue
 		}
-		last = c
 		cc[j] = *c
 		j++
 	}
@@ -474,33 +646,31 @@ func (cc compactionBuffer) Reset() compactionBuffer {
 	return cc[:0]
 }
 
-func (cc compactionBuffer) AppendTo(out []byte) []byte {
+func (cc compactionBuffer) AppendTo(out []byte, layout byte) []byte {
 	for i := range cc {
-		c := &cc[i]
-		out = appendUint64(out, c.id)
-		out = appendUint64(out, uint64(c.n))
+		out = cc[i].AppendTo(out, layout)
 	}
 	return out
 }
 
-func compactionScan(db *badger.DB, id eventID, now time.Time) error {
+func compactionScan(db *badger.DB, id eventID, layout byte, now time.Time) error {
 	txn := db.NewTransaction(false)
 	defer txn.Discard()
 	iter := txn.NewIterator(badger.IteratorOptions{})
 	defer iter.Close()
-	seekEvent(iter, id, time.Time{})
+	seekEvent(iter, id, layout, time.Time{})
 	if !iter.Valid() {
 		return nil
 	}
 	key := iter.Item().Key()
-	ts, ok := parseEventKey(id, key)
+	ts, ok := parseEventKey(id, layout, key)
 	const step = int64(time.Hour)
 	ts = stepTS(ts, step)
 	max := now.Truncate(time.Hour).Add(-1 * time.Hour).Unix()
 	for start, end, n := ts, ts+step, 0; ok && start < max; start, end, n = end, start+step, 0 {
 		for ; iter.Valid(); iter.Next() {
 			key = iter.Item().Key()
-			ts, ok = parseEventKey(id, key)
+			ts, ok = parseEventKey(id, layout, key)
 			if ok && start < ts && ts < end {
 				n++
 			} else if start == ts {
@@ -510,7 +680,7 @@ func compactionScan(db *badger.DB, id eventID, now time.Time) error {
 			}
 		}
 		if n > 0 {
-			err := compactionTask(db, id, start, end)
+			err := compactionTask(db, id, layout, start, end)
 			if err != nil {
 				return err
 			}
@@ -520,25 +690,25 @@ func compactionScan(db *badger.DB, id eventID, now time.Time) error {
 
 }
 
-func compactionTask(db *badger.DB, id eventID, start, end int64) error {
+func compactionTask(db *badger.DB, id eventID, layout byte, start, end int64) error {
 	txn := db.NewTransaction(true)
 	defer txn.Discard()
 	opt := badger.DefaultIteratorOptions
 	iter := txn.NewIterator(opt)
 	defer iter.Close()
-	seek := eventKey(id, start)
+	seek := eventKey(id, layout, start)
 	cc := getCompactionBuffer()
 	defer putCompactionBuffer(cc)
 
 	for iter.Seek(seek[:]); iter.Valid(); iter.Next() {
 		item := iter.Item()
 		key := item.Key()
-		ts, ok := parseEventKey(id, key)
+		ts, ok := parseEventKey(id, layout, key)
 		if !ok || ts >= end {
 			break
 		}
 		err := item.Value(func(v []byte) error {
-			cc = cc.Read(v)
+			cc = cc.Read(v, layout)
 			return nil
 
 		})
@@ -557,7 +727,7 @@ func compactionTask(db *badger.DB, id eventID, start, end int64) error {
 	cc = cc.Compact()
 	if len(cc) > 0 {
 		value := getBuffer()
-		value = cc.AppendTo(value[:0])
+		value = cc.AppendTo(value[:0], layout)
 		defer putBuffer(value)
 		if err := txn.Set(seek[:], value); err != nil {
 			return err
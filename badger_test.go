@@ -1,8 +1,13 @@
 package meter_test
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
 	"testing"
@@ -12,8 +17,8 @@ import (
 	badger "github.com/dgraph-io/badger/v2"
 )
 
-func TestBadgerEvents(t *testing.T) {
-
+func openBadger(t *testing.T) *badger.DB {
+	t.Helper()
 	d := path.Join(os.TempDir(), fmt.Sprintf("meter-test-%d", time.Now().UnixNano()))
 	if err := os.MkdirAll(d, os.ModeDir|os.ModePerm); err != nil {
 		t.Fatal(err)
@@ -26,6 +31,12 @@ func TestBadgerEvents(t *testing.T) {
 	if err != nil {
 		t.Fatal("Failed to open badger", err)
 	}
+	return db
+}
+
+func TestBadgerEvents(t *testing.T) {
+	db := openBadger(t)
+	defer db.Close()
 	events, err := meter.Open(db, "test")
 	if err != nil {
 		t.Fatal("Failed to open badger store", err)
@@ -82,3 +93,153 @@ func TestBadgerEvents(t *testing.T) {
 	}
 
 }
+
+func TestBadgerEvents_Gauge(t *testing.T) {
+	db := openBadger(t)
+	defer db.Close()
+	events, err := meter.Open(db, "queue")
+	if err != nil {
+		t.Fatal("Failed to open badger store", err)
+	}
+	tm := time.Date(2019, time.May, 15, 13, 14, 0, 0, time.UTC)
+	g := meter.NewGauge("queue", "name")
+	sync := g.SyncTask(events)
+	g.Set(4, "jobs")
+	g.Set(2, "jobs")
+	if err := sync(tm); err != nil {
+		t.Fatal("Failed to store gauge", err)
+	}
+	g.Set(9, "jobs")
+	g.Set(5, "jobs")
+	if err := sync(tm.Add(time.Minute)); err != nil {
+		t.Fatal("Failed to store gauge", err)
+	}
+	if err := events.Compaction(tm.Add(3 * time.Hour)); err != nil {
+		t.Fatal("Compaction failed", err)
+	}
+	qr := meter.ScanQueryRunner(events)
+	q := meter.Query{
+		TimeRange: meter.TimeRange{
+			Step:  time.Hour,
+			Start: tm.Add(-1 * time.Hour),
+			End:   tm.Add(time.Hour),
+		},
+	}
+	for agg, want := range map[meter.Aggregate]float64{
+		meter.CountAggregate: 4,
+		meter.SumAggregate:   20,
+		meter.AvgAggregate:   5,
+		meter.MinAggregate:   2,
+		meter.MaxAggregate:   9,
+		meter.LastAggregate:  5,
+	} {
+		q.Aggregate = agg
+		results, err := qr.RunQuery(context.Background(), &q, "queue")
+		if err != nil {
+			t.Fatal("Query failed", err)
+		}
+		if len(results) != 1 || len(results[0].Data) != 1 {
+			t.Fatalf("Invalid %s results %v", agg, results)
+		}
+		AssertEqual(t, results[0].Data[0].Value, int64(4))
+		AssertEqual(t, results[0].Data[0].Aggregate, want)
+	}
+}
+
+func TestBadgerEvents_Sum(t *testing.T) {
+	db := openBadger(t)
+	defer db.Close()
+	events, err := meter.Open(db, "bytes")
+	if err != nil {
+		t.Fatal("Failed to open badger store", err)
+	}
+	tm := time.Date(2019, time.May, 15, 13, 14, 0, 0, time.UTC)
+	e := meter.NewEvent("bytes", "host")
+	sync := e.SyncTask(events)
+	e.AddSum(1, 100, "example.org")
+	e.AddSum(1, 50, "example.org")
+	if err := sync(tm); err != nil {
+		t.Fatal("Failed to store counters", err)
+	}
+	e.AddSum(2, 150, "example.org")
+	if err := sync(tm.Add(time.Minute)); err != nil {
+		t.Fatal("Failed to store counters", err)
+	}
+	if err := events.Compaction(tm.Add(3 * time.Hour)); err != nil {
+		t.Fatal("Compaction failed", err)
+	}
+	qr := meter.ScanQueryRunner(events)
+	q := meter.Query{
+		TimeRange: meter.TimeRange{
+			Step:  time.Hour,
+			Start: tm.Add(-1 * time.Hour),
+			End:   tm.Add(time.Hour),
+		},
+	}
+	for agg, want := range map[meter.Aggregate]float64{
+		meter.CountAggregate: 4,
+		meter.SumAggregate:   300,
+		meter.AvgAggregate:   75,
+	} {
+		q.Aggregate = agg
+		results, err := qr.RunQuery(context.Background(), &q, "bytes")
+		if err != nil {
+			t.Fatal("Query failed", err)
+		}
+		if len(results) != 1 {
+			t.Fatalf("Invalid %s results %v", agg, results)
+		}
+		AssertEqual(t, results[0].Total, int64(4))
+		AssertEqual(t, results[0].Aggregate, want)
+	}
+}
+
+func TestBadgerEvents_Duplicate(t *testing.T) {
+	db := openBadger(t)
+	defer db.Close()
+	events, err := meter.Open(db, "test")
+	if err != nil {
+		t.Fatal("Failed to open badger store", err)
+	}
+	tm := time.Date(2019, time.May, 15, 13, 14, 0, 0, time.UTC)
+	req := meter.StoreRequest{
+		ID:       meter.NewRequestID(),
+		Event:    "test",
+		Time:     tm,
+		Labels:   []string{"color"},
+		Counters: meter.Snapshot{{Values: []string{"blue"}, Count: 1}},
+	}
+	AssertNil(t, events.Store(&req))
+	AssertEqual(t, events.Store(&req), meter.ErrDuplicate)
+	req.ID = ""
+	AssertNil(t, events.Store(&req))
+	AssertNil(t, events.Store(&req))
+
+	srv := httptest.NewServer(meter.StoreHandler(events))
+	defer srv.Close()
+	req.ID = meter.NewRequestID()
+	post := func() string {
+		body, _ := json.Marshal(&req)
+		res, err := http.Post(srv.URL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		data, _ := ioutil.ReadAll(res.Body)
+		return string(data)
+	}
+	AssertEqual(t, post(), `{"status":"OK"}`)
+	AssertEqual(t, post(), `{"status":"OK","duplicate":true}`)
+
+	q := meter.Query{
+		TimeRange: meter.TimeRange{
+			Step:  time.Hour,
+			Start: tm.Add(-1 * time.Hour),
+			End:   tm.Add(time.Hour),
+		},
+	}
+	results, err := meter.ScanQueryRunner(events).RunQuery(context.Background(), &q, "test")
+	AssertNil(t, err)
+	AssertEqual(t, len(results), 1)
+	AssertEqual(t, results[0].Total, int64(4))
+}
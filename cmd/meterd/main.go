@@ -2,12 +2,16 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
+	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"path"
+	"strings"
 	"syscall"
 	"time"
 
@@ -18,10 +22,98 @@ import (
 var (
 	dataDir = flag.String("dir", "", "Data dir")
 	addr    = flag.String("address", ":8080", "HTTP Listen address")
+	tokens  = flag.String("tokens", "", "JSON file with auth tokens, reloaded on SIGHUP")
+	tlsCert = flag.String("tls-cert", "", "TLS certificate file, reloaded on SIGHUP")
+	tlsKey  = flag.String("tls-key", "", "TLS key file")
+	tlsCA   = flag.String("tls-client-ca", "", "CA file to verify client certificates, reloaded on SIGHUP")
+	source  = flag.String("tls-source-label", "", "Label for the client certificate identity on stored events")
+	scrape  = flag.String("scrape", "", "JSON file with Prometheus scrape targets")
+	statsd  = flag.String("statsd", "", "UDP listen address for StatsD counters")
+	mapping = flag.String("statsd-config", "", "JSON file with StatsD metric mappings")
+	otlp    = flag.String("otlp-resource-attributes", "", "Comma separated OTLP resource attributes added as labels, \"*\" adds all")
+	stdin   = flag.Bool("stdin", false, "Read NDJSON store requests from stdin, skips token auth")
+	tail    = flag.String("tail", "", "Tail a file with NDJSON store requests, skips token auth")
+	tailAll = flag.Bool("tail-from-start", false, "Read lines already in the tailed file")
+	unix    = flag.String("unix", "", "Unix socket path for NDJSON store requests, only accessible by the owner and skips token auth")
+	dedup   = flag.Duration("dedup", meter.DefaultRequestRetention, "Retention of request IDs to detect duplicates")
 )
 
+// scrapeConfig is the config of Prometheus scrape targets
+type scrapeConfig struct {
+	Interval string               `json:"interval"`
+	Targets  []meter.ScrapeTarget `json:"targets"`
+}
+
+func loadScrapeConfig(filename string) (*meter.Scraper, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	config := scrapeConfig{}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+	s := meter.Scraper{
+		Targets: config.Targets,
+	}
+	if config.Interval != "" {
+		if s.Interval, err = time.ParseDuration(config.Interval); err != nil {
+			return nil, err
+		}
+	}
+	return &s, nil
+}
+
+// statsdConfig is the config of StatsD metric mappings
+type statsdConfig struct {
+	Interval string                `json:"interval"`
+	Mappings []meter.StatsdMapping `json:"mappings"`
+}
+
+func loadStatsdConfig(filename string) (*statsdConfig, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	config := statsdConfig{}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
 func main() {
 	flag.Parse()
+	eventNames := flag.Args()
+	var scraper *meter.Scraper
+	if *scrape != "" {
+		var err error
+		if scraper, err = loadScrapeConfig(*scrape); err != nil {
+			log.Fatal("Failed to load scrape config", err)
+		}
+		for _, t := range scraper.Targets {
+			for _, m := range t.Metrics {
+				eventNames = append(eventNames, m.Event)
+			}
+		}
+	}
+	var statsdMappings *statsdConfig
+	if *statsd != "" {
+		if *mapping == "" {
+			log.Fatal("StatsD listener requires -statsd-config")
+		}
+		var err error
+		if statsdMappings, err = loadStatsdConfig(*mapping); err != nil {
+			log.Fatal("Failed to load StatsD config", err)
+		}
+		for _, m := range statsdMappings.Mappings {
+			name := m.Event
+			if name == "" {
+				name = m.Metric
+			}
+			eventNames = append(eventNames, name)
+		}
+	}
 	if *dataDir == "" {
 		*dataDir = path.Join(os.TempDir(), "meterd")
 		if err := os.MkdirAll(*dataDir, os.ModePerm); err != nil {
@@ -38,11 +130,13 @@ func main() {
 		log.Fatal("Failed to open badger DB", err)
 	}
 	defer db.Close()
-	events, err := meter.Open(db, flag.Args()...)
+	events, err := meter.Open(db, distinct(eventNames)...)
 	if err != nil {
 		log.Fatal("Failed to open event db", err)
 	}
-	ctx := context.Background()
+	events.SetRequestRetention(*dedup)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	go func() {
 		tick := time.NewTicker(time.Hour)
 		run := func(tm time.Time) {
@@ -61,16 +155,123 @@ func main() {
 			}
 		}
 	}()
+	if scraper != nil {
+		scraper.Store = events
+		scraper.OnError = func(target string, err error) {
+			log.Println("Scrape failed", target, err)
+		}
+		go scraper.Run(ctx)
+	}
+	statsdDone := make(chan struct{})
+	if statsdMappings != nil {
+		interval := meter.DefaultSyncInterval
+		if statsdMappings.Interval != "" {
+			if interval, err = time.ParseDuration(statsdMappings.Interval); err != nil {
+				log.Fatal("Invalid StatsD interval", err)
+			}
+		}
+		listener, err := meter.NewStatsdListener(events, interval, statsdMappings.Mappings...)
+		if err != nil {
+			log.Fatal("Invalid StatsD config", err)
+		}
+		listener.OnError = func(event string, err error) {
+			log.Println("StatsD sync failed", event, err)
+		}
+		conn, err := net.ListenPacket("udp", *statsd)
+		if err != nil {
+			log.Fatal("Failed to listen for StatsD", err)
+		}
+		log.Println("Listening for StatsD on", *statsd)
+		go func() {
+			defer close(statsdDone)
+			if err := listener.Serve(ctx, conn); err != nil {
+				log.Println("StatsD listener failed", err)
+			}
+		}()
+	} else {
+		close(statsdDone)
+	}
+	ingester := meter.StreamIngester{
+		Store: events,
+		OnError: func(source string, err *meter.LineError) {
+			log.Println("Invalid store request", source, err)
+		},
+	}
+	if *stdin {
+		go func() {
+			if err := ingester.Ingest(ctx, "stdin", os.Stdin); err != nil {
+				log.Println("Failed to read stdin", err)
+			}
+		}()
+	}
+	if *tail != "" {
+		go func() {
+			if err := ingester.TailFile(ctx, *tail, *tailAll); err != nil {
+				log.Println("Failed to tail", *tail, err)
+			}
+		}()
+	}
+	if *unix != "" {
+		// Remove a stale socket of a previous run
+		if info, err := os.Stat(*unix); err == nil && info.Mode()&os.ModeSocket != 0 {
+			if err := os.Remove(*unix); err != nil {
+				log.Fatal("Failed to remove stale unix socket", err)
+			}
+		}
+		// Socket requests skip token auth so only the owner can connect,
+		// the socket is created with owner only permissions
+		umask := syscall.Umask(0077)
+		l, err := net.Listen("unix", *unix)
+		syscall.Umask(umask)
+		if err != nil {
+			log.Fatal("Failed to listen on unix socket", err)
+		}
+		log.Println("Listening on", *unix)
+		go func() {
+			if err := ingester.Serve(ctx, l); err != nil {
+				log.Println("Unix socket listener failed", err)
+			}
+		}()
+	}
 	q := meter.ScanQueryRunner(events)
 	queryHandler := meter.QueryHandler(q)
 	storeHandler := meter.StoreHandler(events)
-	mux := http.NewServeMux()
-	mux.HandleFunc("/debug", func(w http.ResponseWriter, r *http.Request) {
+	writeHandler := meter.LineProtocolHandler(events)
+	otlpReceiver := &meter.OTLPReceiver{Store: events}
+	if *otlp != "" {
+		otlpReceiver.ResourceAttributes = strings.Split(*otlp, ",")
+	}
+	otlpHandler := http.HandlerFunc(otlpReceiver.ServeHTTP)
+	debugHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		for _, e := range events {
 			meter.DumpKeys(e.DB, w)
 			return
 		}
 	})
+	var reload []func() error
+	if *tokens != "" {
+		auth, err := meter.LoadTokenAuth(*tokens)
+		if err != nil {
+			log.Fatal("Failed to load auth tokens", err)
+		}
+		reload = append(reload, auth.Reload)
+		queryHandler = meter.RequireAuth(auth, meter.ScopeRead, queryHandler)
+		storeHandler = meter.RequireAuth(auth, meter.ScopeWrite, storeHandler)
+		writeHandler = meter.RequireAuth(auth, meter.ScopeWrite, writeHandler)
+		otlpHandler = meter.RequireAuth(auth, meter.ScopeWrite, otlpHandler)
+		debugHandler = meter.RequireAuth(auth, meter.ScopeDebug, debugHandler)
+	}
+	if *source != "" {
+		storeHandler = meter.ClientCertFields(*source, storeHandler)
+		writeHandler = meter.ClientCertFields(*source, writeHandler)
+		otlpHandler = meter.ClientCertFields(*source, otlpHandler)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/debug", debugHandler)
+	// InfluxDB v1 and v2 write endpoints
+	mux.Handle("/write", writeHandler)
+	mux.Handle("/api/v2/write", writeHandler)
+	mux.HandleFunc("/v1/metrics", otlpHandler)
 	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case http.MethodPost:
@@ -88,6 +289,28 @@ func main() {
 		MaxHeaderBytes:    4096,
 		ReadHeaderTimeout: 5 * time.Second,
 	}
+	if *tlsCert != "" {
+		certs, err := meter.LoadCertReloader(*tlsCert, *tlsKey)
+		if err != nil {
+			log.Fatal("Failed to load TLS certificate", err)
+		}
+		reload = append(reload, certs.Reload)
+		s.TLSConfig, err = meter.ServerTLSConfig(certs, *tlsCA)
+		if err != nil {
+			log.Fatal("Failed to load TLS client CA", err)
+		}
+	}
+	go func() {
+		sighup := make(chan os.Signal, 1)
+		signal.Notify(sighup, syscall.SIGHUP)
+		for range sighup {
+			for _, r := range reload {
+				if err := r(); err != nil {
+					log.Println("Reload failed", err)
+				}
+			}
+		}
+	}()
 	// Graceful shutdown
 	done := make(chan struct{})
 	go func() {
@@ -100,9 +323,31 @@ func main() {
 	}()
 	// http.Handle("/events/", http.StripPrefix("/events", meter.Handler(events)))
 	log.Println("Listening on", *addr)
-	if err := s.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+	listen := s.ListenAndServe
+	if s.TLSConfig != nil {
+		listen = func() error {
+			// Certificates are provided by TLSConfig
+			return s.ListenAndServeTLS("", "")
+		}
+	}
+	if err := listen(); err != nil && err != http.ErrServerClosed {
 		log.Fatal(err)
 	}
 	log.Println("Server closed")
 	<-done
+	// Final sync of StatsD counters
+	cancel()
+	<-statsdDone
+}
+
+func distinct(names []string) []string {
+	seen := make(map[string]bool, len(names))
+	out := names[:0]
+	for _, name := range names {
+		if !seen[name] {
+			seen[name] = true
+			out = append(out, name)
+		}
+	}
+	return out
 }
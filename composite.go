@@ -0,0 +1,155 @@
+package meter
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StoreErrors are the errors of multiple stores
+type StoreErrors []error
+
+func (errs StoreErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// err returns nil if there are no errors
+func (errs StoreErrors) err() error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// TeeStore is an EventStore storing requests to all of its stores concurrently
+//
+// Stores must not modify requests.
+// An error is returned if any store fails. SyncTask resends an unchanged failed
+// request with the same ID to all stores, so stores that succeeded must ignore
+// duplicate IDs, like the badger store does, for the request to be counted once.
+type TeeStore []EventStore
+
+// Store implements EventStore interface
+func (stores TeeStore) Store(req *StoreRequest) error {
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs StoreErrors
+	)
+	wg.Add(len(stores))
+	for _, s := range stores {
+		go func(s EventStore) {
+			defer wg.Done()
+			if err := s.Store(req); err != nil && !errors.Is(err, ErrDuplicate) {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+			}
+		}(s)
+	}
+	wg.Wait()
+	return errs.err()
+}
+
+// DefaultFailoverCooldown is the default time a failed store is skipped by a FailoverStore
+const DefaultFailoverCooldown = 30 * time.Second
+
+// FailoverStore is an EventStore storing requests to the first healthy of its stores
+//
+// A store that fails with a retryable error, such as a network error or a 5xx response,
+// is skipped for Cooldown. If all stores are unhealthy they are all tried.
+// Requests rejected by a store are not retried on the other stores and the error is returned.
+type FailoverStore struct {
+	// RoundRobin spreads requests across healthy stores instead of preferring the first
+	RoundRobin bool
+	// Cooldown is the time a failed store is skipped, defaults to DefaultFailoverCooldown
+	Cooldown time.Duration
+
+	stores []EventStore
+	mu     sync.Mutex
+	next   int
+	down   []time.Time
+}
+
+// NewFailoverStore creates a FailoverStore trying stores in order
+func NewFailoverStore(stores ...EventStore) *FailoverStore {
+	return &FailoverStore{
+		stores: stores,
+		down:   make([]time.Time, len(stores)),
+	}
+}
+
+// Store implements EventStore interface
+func (f *FailoverStore) Store(req *StoreRequest) error {
+	var errs StoreErrors
+	for _, i := range f.order(time.Now()) {
+		err := f.stores[i].Store(req)
+		if err == nil || errors.Is(err, ErrDuplicate) {
+			f.mark(i, time.Time{})
+			return nil
+		}
+		if !retryable(err) {
+			f.mark(i, time.Time{})
+			return err
+		}
+		f.mark(i, time.Now().Add(f.cooldown()))
+		errs = append(errs, err)
+	}
+	if len(f.stores) == 0 {
+		return errors.New("No stores")
+	}
+	return errs
+}
+
+// Healthy reports the health of each store
+func (f *FailoverStore) Healthy() []bool {
+	now := time.Now()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	healthy := make([]bool, len(f.down))
+	for i, tm := range f.down {
+		healthy[i] = !now.Before(tm)
+	}
+	return healthy
+}
+
+func (f *FailoverStore) cooldown() time.Duration {
+	if f.Cooldown > 0 {
+		return f.Cooldown
+	}
+	return DefaultFailoverCooldown
+}
+
+func (f *FailoverStore) mark(i int, down time.Time) {
+	f.mu.Lock()
+	f.down[i] = down
+	f.mu.Unlock()
+}
+
+// order returns the indexes of stores to try, healthy stores first
+func (f *FailoverStore) order(now time.Time) []int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := len(f.stores)
+	start := 0
+	if f.RoundRobin && n > 0 {
+		start = f.next % n
+		f.next++
+	}
+	order := make([]int, 0, n)
+	var unhealthy []int
+	for j := 0; j < n; j++ {
+		i := (start + j) % n
+		if now.Before(f.down[i]) {
+			unhealthy = append(unhealthy, i)
+			continue
+		}
+		order = append(order, i)
+	}
+	return append(order, unhealthy...)
+}
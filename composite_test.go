@@ -0,0 +1,111 @@
+package meter_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	meter "github.com/alxarch/go-meter/v2"
+)
+
+func TestTeeStore(t *testing.T) {
+	db := openBadger(t)
+	defer db.Close()
+	events, err := meter.Open(db, "foo")
+	AssertNil(t, err)
+	remote := &testStore{}
+	srv := httptest.NewServer(meter.StoreHandler(remote))
+	defer srv.Close()
+	local := &testStore{}
+	tee := meter.TeeStore{events, &meter.HTTPStore{URL: srv.URL}, local}
+	req := meter.StoreRequest{
+		ID:       meter.NewRequestID(),
+		Event:    "foo",
+		Time:     time.Now(),
+		Labels:   []string{"color"},
+		Counters: meter.Snapshot{{Values: []string{"blue"}, Count: 1}},
+	}
+	AssertNil(t, tee.Store(&req))
+	AssertEqual(t, len(remote.data), 1)
+	AssertEqual(t, len(local.data), 1)
+
+	// Only the failed store is reported, badger ignores the duplicate request
+	local.setFail(true)
+	err = tee.Store(&req)
+	AssertEqual(t, err, meter.StoreErrors{errors.New("Store failed")})
+	AssertEqual(t, len(remote.data), 2)
+
+	// Synced requests are resent with the same ID
+	tee = meter.TeeStore{events, local}
+	e := meter.NewEvent("foo", "color")
+	sync := e.SyncTask(tee)
+	e.Add(1, "red")
+	Assert(t, sync(req.Time) != nil, "Sync did not fail")
+	local.setFail(false)
+	AssertNil(t, sync(req.Time))
+	AssertEqual(t, local.data[1].Counters, meter.Snapshot{{Values: []string{"red"}, Count: 1}})
+	q := meter.Query{
+		TimeRange: meter.TimeRange{
+			Step:  time.Hour,
+			Start: req.Time.Add(-time.Hour),
+			End:   req.Time.Add(time.Hour),
+		},
+		Match: meter.Fields{{Label: "color", Value: "red"}},
+	}
+	results, err := meter.ScanQueryRunner(events).RunQuery(context.Background(), &q, "foo")
+	AssertNil(t, err)
+	AssertEqual(t, len(results), 1)
+	AssertEqual(t, results[0].Total, int64(1))
+}
+
+func TestFailoverStore(t *testing.T) {
+	a, b := &testStore{}, &testStore{}
+	srv := httptest.NewServer(meter.StoreHandler(b))
+	defer srv.Close()
+	f := meter.NewFailoverStore(a, &meter.HTTPStore{URL: srv.URL})
+	f.Cooldown = time.Hour
+	req := &meter.StoreRequest{Event: "foo", Time: time.Now()}
+	AssertNil(t, f.Store(req))
+	AssertEqual(t, len(a.data), 1)
+
+	a.setFail(true)
+	AssertNil(t, f.Store(req))
+	AssertEqual(t, len(b.data), 1)
+	AssertEqual(t, f.Healthy(), []bool{false, true})
+	a.setFail(false)
+	// Unhealthy store is skipped during cooldown
+	AssertNil(t, f.Store(req))
+	AssertEqual(t, len(a.data), 1)
+	AssertEqual(t, len(b.data), 2)
+
+	b.setFail(true)
+	AssertNil(t, f.Store(req))
+	AssertEqual(t, len(a.data), 2)
+	AssertEqual(t, f.Healthy(), []bool{true, false})
+	a.setFail(true)
+	Assert(t, f.Store(req) != nil, "Failed stores succeeded")
+
+	a.setFail(false)
+	b.setFail(false)
+	f = meter.NewFailoverStore(a, b)
+	f.RoundRobin = true
+	for i := 0; i < 4; i++ {
+		AssertNil(t, f.Store(req))
+	}
+	AssertEqual(t, len(a.data), 4)
+	AssertEqual(t, len(b.data), 4)
+
+	// Rejected requests do not fail over
+	rejecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		code := http.StatusBadRequest
+		http.Error(w, http.StatusText(code), code)
+	}))
+	defer rejecting.Close()
+	f = meter.NewFailoverStore(&meter.HTTPStore{URL: rejecting.URL}, b)
+	Assert(t, f.Store(req) != nil, "Rejected request stored")
+	AssertEqual(t, len(b.data), 4)
+	AssertEqual(t, f.Healthy(), []bool{true, true})
+}
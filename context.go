@@ -0,0 +1,59 @@
+package meter
+
+import "context"
+
+type fieldsContextKey struct{}
+
+// ContextWithFields returns a copy of ctx carrying fields
+//
+// Fields already in ctx are kept unless overridden by a field with the same label.
+func ContextWithFields(ctx context.Context, fields ...Field) context.Context {
+	parent := FieldsFromContext(ctx)
+	merged := make(Fields, len(parent), len(parent)+len(fields))
+	copy(merged, parent)
+	for _, f := range fields {
+		merged = merged.set(f.Label, f.Value)
+	}
+	return context.WithValue(ctx, fieldsContextKey{}, merged)
+}
+
+// FieldsFromContext returns the fields carried by ctx
+func FieldsFromContext(ctx context.Context) Fields {
+	if fields, ok := ctx.Value(fieldsContextKey{}).(Fields); ok {
+		return fields
+	}
+	return nil
+}
+
+// AddContext adds n to the counter matching values and the fields carried by ctx
+//
+// Values are positional as in Add. Empty or missing values take the value
+// of the ctx field with the same label or EmptyValue if there is none.
+func (e *Event) AddContext(ctx context.Context, n int64, values ...string) int64 {
+	fields := FieldsFromContext(ctx)
+	if len(fields) == 0 && len(values) == len(e.Labels) {
+		return e.Add(n, values...)
+	}
+	var buf [8]string
+	vs := buf[:0]
+	for i, label := range e.Labels {
+		if i < len(values) && values[i] != "" {
+			vs = append(vs, values[i])
+			continue
+		}
+		if v, ok := fields.Get(label); ok {
+			vs = append(vs, v)
+			continue
+		}
+		vs = append(vs, e.EmptyValue)
+	}
+	return e.Add(n, vs...)
+}
+
+// contextValue returns the value of label in ctx fields or EmptyValue
+func (e *Event) contextValue(ctx context.Context, label string) string {
+	if v, ok := FieldsFromContext(ctx).Get(label); ok {
+		return v
+	}
+	return e.EmptyValue
+}
@@ -0,0 +1,34 @@
+package meter_test
+
+import (
+	"context"
+	"testing"
+
+	meter "github.com/alxarch/go-meter/v2"
+)
+
+func Test_EventAddContext(t *testing.T) {
+	e := meter.NewEvent("foo", "tenant", "route", "status")
+	e.EmptyValue = "*"
+	ctx := meter.ContextWithFields(context.Background(), meter.Field{Label: "tenant", Value: "acme"})
+	ctx = meter.ContextWithFields(ctx,
+		meter.Field{Label: "route", Value: "/bar"},
+		meter.Field{Label: "app", Value: "cli"},
+	)
+	AssertEqual(t, len(meter.FieldsFromContext(ctx)), 3)
+	e.AddContext(ctx, 1, "", "", "200")
+	e.AddContext(ctx, 1)
+	e.AddContext(ctx, 1, "", "/qux", "200")
+	e.AddContext(context.Background(), 1, "other", "/baz", "500")
+	child := meter.ContextWithFields(ctx, meter.Field{Label: "tenant", Value: "other"})
+	e.AddContext(child, 1, "", "", "200")
+	tenant, _ := meter.FieldsFromContext(ctx).Get("tenant")
+	AssertEqual(t, tenant, "acme")
+	AssertSnapshot(t, e.Flush(nil), meter.Snapshot{
+		{Values: []string{"acme", "/bar", "200"}, Count: 1},
+		{Values: []string{"acme", "/bar", "*"}, Count: 1},
+		{Values: []string{"acme", "/qux", "200"}, Count: 1},
+		{Values: []string{"other", "/baz", "500"}, Count: 1},
+		{Values: []string{"other", "/bar", "200"}, Count: 1},
+	})
+}
@@ -7,17 +7,29 @@ import (
 
 // Counter counts events labeled by values
 type Counter struct {
-	Count  int64    `json:"n"`
+	Count int64 `json:"n"`
+	// Sum of quantities added with AddSum or gauge values
+	// It is kept next to Count so both are 64-bit aligned for atomic access
+	Sum    float64  `json:"sum,omitempty"`
 	Values []string `json:"v,omitempty"`
+	// Aggregates of gauge values
+	Min  float64 `json:"min,omitempty"`
+	Max  float64 `json:"max,omitempty"`
+	Last float64 `json:"last,omitempty"`
 }
 
 // Snapshot is a slice of counters
 type Snapshot []Counter
 
 // UnsafeCounters is an index of counters not safe for concurrent use
+//
+// Counters are allocated separately so pointers to them remain valid
+// when the index grows or is packed.
 type UnsafeCounters struct {
-	counters Snapshot
+	counters []*Counter
 	index    map[uint64][]int
+	// bound counts the handles bound to each counter
+	bound map[*Counter]int
 }
 
 // Len returns the number of counters in an Event
@@ -26,24 +38,53 @@ func (cs *UnsafeCounters) Len() int {
 }
 
 // Counters is an index of counters safe for councurrent use
+//
+// Counters are sharded by the hash of their values so that
+// concurrent updates of different values rarely contend for a lock.
 type Counters struct {
+	size   int64 // Total number of counters, accessed atomically
+	shards [numShards]counterShard
+	lmu    sync.RWMutex
+	limits *counterLimits
+	// flushed are called with the counters flushed from each shard
+	flushed []func(Snapshot)
+}
+
+const numShards = 16
+
+type counterShard struct {
 	mu       sync.RWMutex
 	counters UnsafeCounters
+	// Avoid false sharing of shard locks
+	_ [64]byte
+}
+
+func (cs *Counters) shard(h uint64) *counterShard {
+	return &cs.shards[h%numShards]
 }
 
 // Len returns the number of counters in an Event
-func (cs *Counters) Len() (n int) {
-	cs.mu.RLock()
-	n = cs.counters.Len()
-	cs.mu.RUnlock()
-	return
+func (cs *Counters) Len() int {
+	return int(atomic.LoadInt64(&cs.size))
 }
 
 // Pack packs the counter index dropping zero counters
 func (cs *Counters) Pack() {
-	cs.mu.Lock()
-	cs.counters.Pack()
-	cs.mu.Unlock()
+	var counters []*Counter
+	for i := range cs.shards {
+		s := &cs.shards[i]
+		s.mu.Lock()
+		n := s.counters.Len()
+		s.counters.Pack()
+		atomic.AddInt64(&cs.size, int64(s.counters.Len()-n))
+		counters = append(counters, s.counters.counters...)
+		s.mu.Unlock()
+	}
+	cs.lmu.Lock()
+	if cs.limits != nil {
+		cs.limits.reset(counters)
+	}
+	cs.lmu.Unlock()
 }
 
 // Match checks if values match counter's own values
@@ -59,32 +100,48 @@ func (cs *UnsafeCounters) Add(n int64, values ...string) int64 {
 	return c.Count
 }
 
+// AddSum increments a counter matching values by n and its sum by v
+func (cs *UnsafeCounters) AddSum(n int64, v float64, values ...string) float64 {
+	h := vhash(values)
+	c := cs.findOrCreate(h, values)
+	c.Count += n
+	c.Sum += v
+	return c.Sum
+}
+
 // Flush appends all counters to a snapshot and resets them to zero
 func (cs *UnsafeCounters) Flush(s Snapshot) Snapshot {
-	s = append(s, cs.counters...)
-	cs.counters.Zero()
+	for _, c := range cs.counters {
+		s = append(s, *c)
+		c.Count = 0
+		c.Sum, c.Min, c.Max, c.Last = 0, 0, 0, 0
+	}
 	return s
 }
 
 func (cs *UnsafeCounters) findOrCreate(h uint64, values []string) *Counter {
+	if c := cs.find(h, values); c != nil {
+		return c
+	}
+	return cs.create(h, values)
+}
+
+func (cs *UnsafeCounters) create(h uint64, values []string) *Counter {
 	if cs.index == nil {
 		cs.index = make(map[uint64][]int, 64)
-	} else if c := cs.find(h, values); c != nil {
-		return c
 	}
-	i := len(cs.counters)
-	cs.counters = append(cs.counters, Counter{
+	c := &Counter{
 		Values: vdeepcopy(values),
-	})
-	cs.index[h] = append(cs.index[h], i)
-	return cs.Get(i)
-
+	}
+	cs.index[h] = append(cs.index[h], len(cs.counters))
+	cs.counters = append(cs.counters, c)
+	return c
 }
 
 func (cs *UnsafeCounters) find(h uint64, values []string) *Counter {
 	for _, i := range cs.index[h] {
 		if 0 <= i && i < len(cs.counters) {
-			c := &cs.counters[i]
+			c := cs.counters[i]
 			if c.Match(values) {
 				return c
 			}
@@ -96,49 +153,125 @@ func (cs *UnsafeCounters) find(h uint64, values []string) *Counter {
 // Get returns the counter at index i
 func (cs *UnsafeCounters) Get(i int) *Counter {
 	if 0 <= i && i < len(cs.counters) {
-		return &cs.counters[i]
+		return cs.counters[i]
 	}
 	return nil
 }
 
-// Add adds n to a specific counter
-func (cs *Counters) Add(n int64, values ...string) int64 {
+// get returns the counter matching values creating it if needed
+//
+// Values rejected by limits are looked up under the limits read lock.
+// The size of the index is incremented while holding the limits lock
+// so that concurrent creates in different shards cannot exceed MaxSize.
+func (cs *Counters) get(h uint64, values []string) *Counter {
+	dropped := false
+	for {
+		s := cs.shard(h)
+		s.mu.RLock()
+		c := s.counters.find(h, values)
+		s.mu.RUnlock()
+		if c != nil {
+			return c
+		}
+		cs.lmu.RLock()
+		var replace []string
+		if l := cs.limits; l != nil {
+			replace = l.replacement(h, values)
+		}
+		cs.lmu.RUnlock()
+		if replace != nil {
+			values, h, dropped = replace, vhash(replace), true
+			continue
+		}
+		s.mu.Lock()
+		if c = s.counters.find(h, values); c != nil {
+			s.mu.Unlock()
+			return c
+		}
+		cs.lmu.Lock()
+		if l := cs.limits; l != nil {
+			if replace = l.replacement(h, values); replace == nil {
+				if overflow, ok := l.apply(values, cs.Len()); ok {
+					l.reject(h, values, overflow)
+					// Values replaced by both label and size limits are dropped once
+					if !dropped {
+						l.dropped++
+					}
+					replace = overflow
+				}
+			}
+			if replace != nil {
+				cs.lmu.Unlock()
+				s.mu.Unlock()
+				values, h, dropped = replace, vhash(replace), true
+				continue
+			}
+			l.record(values)
+		}
+		atomic.AddInt64(&cs.size, 1)
+		cs.lmu.Unlock()
+		c = s.counters.create(h, values)
+		s.mu.Unlock()
+		return c
+	}
+}
+
+// lock returns the counter matching values with its shard locked
+func (cs *Counters) lock(values []string) (*counterShard, *Counter) {
 	h := vhash(values)
-	cs.mu.RLock()
-	c := cs.counters.find(h, values)
-	cs.mu.RUnlock()
-	if c == nil {
-		cs.mu.Lock()
-		c = cs.counters.findOrCreate(h, values)
-		cs.mu.Unlock()
+	for {
+		s := cs.shard(h)
+		s.mu.Lock()
+		if c := s.counters.find(h, values); c != nil {
+			return s, c
+		}
+		s.mu.Unlock()
+		if c := cs.get(h, values); !c.Match(values) {
+			// Values were replaced due to limits
+			values = c.Values
+			h = vhash(values)
+		}
 	}
+}
+
+// Add adds n to a specific counter
+func (cs *Counters) Add(n int64, values ...string) int64 {
+	c := cs.get(vhash(values), values)
 	return atomic.AddInt64(&c.Count, n)
 }
 
-// Merge adds all counters from a Snapshot
+// AddSum adds n to a specific counter and v to its sum
+func (cs *Counters) AddSum(n int64, v float64, values ...string) float64 {
+	c := cs.get(vhash(values), values)
+	atomic.AddInt64(&c.Count, n)
+	return atomicAddFloat64(&c.Sum, v)
+}
+
+// Merge merges all counters from a Snapshot
 func (cs *Counters) Merge(s Snapshot) {
 	for i := range s {
 		c := &s[i]
-		cs.Add(c.Count, c.Values...)
+		shard, dst := cs.lock(c.Values)
+		dst.merge(c)
+		shard.mu.Unlock()
 	}
 }
 
 // Pack packs the counter index dropping zero counters
+//
+// Counters bound to a Handle are not dropped until all its handles are released.
 func (cs *UnsafeCounters) Pack() {
 	if len(cs.counters) == 0 {
 		return
 	}
-	counters := make([]Counter, 0, len(cs.counters))
+	counters := make([]*Counter, 0, len(cs.counters))
 	for h, idx := range cs.index {
 		packed := idx[:0]
 		for _, i := range idx {
 			c := cs.Get(i)
-			if c.Count != 0 {
+			if cs.keep(c) {
 				packed = append(packed, len(counters))
-				counters = append(counters, Counter{
-					Count:  c.Count,
-					Values: c.Values,
-				})
+				counters = append(counters, c)
 			}
 		}
 		if len(packed) == 0 {
@@ -150,6 +283,11 @@ func (cs *UnsafeCounters) Pack() {
 	cs.counters = counters
 }
 
+func (cs *UnsafeCounters) keep(c *Counter) bool {
+	_, bound := cs.bound[c]
+	return bound || c.Count != 0 || c.Sum != 0
+}
+
 // FilterZero filters out empty counters in-place
 func (s Snapshot) FilterZero() Snapshot {
 	j := 0
@@ -177,6 +315,7 @@ func (s Snapshot) Zero() {
 	for i := range s {
 		c := &s[i]
 		c.Count = 0
+		c.Sum, c.Min, c.Max, c.Last = 0, 0, 0, 0
 	}
 }
 
@@ -196,26 +335,82 @@ func putSnapshot(s Snapshot) {
 
 // Flush appends counters to a Snapshot and resets all counters to zero
 func (cs *Counters) Flush(s Snapshot) Snapshot {
-	src := cs.counters.counters
-	cs.mu.RLock()
-	for i := range src {
-		c := &src[i]
-		s = append(s, Counter{
-			Count:  atomic.SwapInt64(&c.Count, 0),
-			Values: c.Values,
-		})
-	}
-	cs.mu.RUnlock()
+	cs.lmu.RLock()
+	flushed := cs.flushed
+	cs.lmu.RUnlock()
+	for i := range cs.shards {
+		shard := &cs.shards[i]
+		shard.mu.Lock()
+		start := len(s)
+		for _, c := range shard.counters.counters {
+			n, sum := atomic.SwapInt64(&c.Count, 0), atomicSwapFloat64(&c.Sum, 0)
+			s = append(s, Counter{
+				Count:  n,
+				Values: c.Values,
+				Sum:    sum,
+				Min:    c.Min,
+				Max:    c.Max,
+				Last:   c.Last,
+			})
+			c.Min, c.Max, c.Last = 0, 0, 0
+		}
+		for _, fn := range flushed {
+			fn(s[start:])
+		}
+		shard.mu.Unlock()
+	}
 	return s
 }
 
+// unflush merges back a flushed snapshot that failed to sync
+//
+// Flush observers are called with the negated counts so they are not counted twice.
+func (cs *Counters) unflush(s Snapshot) {
+	cs.lmu.RLock()
+	flushed := cs.flushed
+	cs.lmu.RUnlock()
+	for i := range s {
+		c := &s[i]
+		shard, dst := cs.lock(c.Values)
+		dst.merge(c)
+		if len(flushed) > 0 {
+			neg := Snapshot{{Values: dst.Values, Count: -c.Count, Sum: -c.Sum, Last: c.Last}}
+			for _, fn := range flushed {
+				fn(neg)
+			}
+		}
+		shard.mu.Unlock()
+	}
+}
+
 // NewCounters creates a new counter index of size capacity
 func NewCounters(size int) *Counters {
-	cs := Counters{
-		counters: UnsafeCounters{
-			counters: make([]Counter, 0, size),
+	cs := Counters{}
+	size = size/numShards + 1
+	for i := range cs.shards {
+		cs.shards[i].counters = UnsafeCounters{
+			counters: make([]*Counter, 0, size),
 			index:    make(map[uint64][]int, size),
-		},
+		}
 	}
 	return &cs
 }
+
+// onFlush adds a function called with the counters flushed from each shard
+//
+// It is called while the shard is locked so it is consistent with view.
+func (cs *Counters) onFlush(fn func(Snapshot)) {
+	cs.lmu.Lock()
+	cs.flushed = append(cs.flushed[:len(cs.flushed):len(cs.flushed)], fn)
+	cs.lmu.Unlock()
+}
+
+// view calls fn with the counters of each shard while the shard is read locked
+func (cs *Counters) view(fn func(counters []*Counter)) {
+	for i := range cs.shards {
+		shard := &cs.shards[i]
+		shard.mu.RLock()
+		fn(shard.counters.counters)
+		shard.mu.RUnlock()
+	}
+}
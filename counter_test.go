@@ -1,6 +1,9 @@
 package meter_test
 
 import (
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 
 	"github.com/alxarch/go-meter/v2"
@@ -17,3 +20,86 @@ func Test_UnsafeCounters(t *testing.T) {
 	AssertEqual(t, cc.Get(0).Count, int64(0))
 
 }
+
+func Test_CountersAddSum(t *testing.T) {
+	e := meter.NewEvent("bytes", "host")
+	e.AddSum(1, 512, "example.org")
+	AssertEqual(t, e.AddSum(2, 1024.5, "example.org"), 1536.5)
+	s := e.Flush(nil)
+	AssertEqual(t, s, meter.Snapshot{{
+		Values: []string{"example.org"},
+		Count:  3,
+		Sum:    1536.5,
+	}})
+	e.Merge(s)
+	AssertEqual(t, e.Flush(nil)[0].Sum, 1536.5)
+	AssertEqual(t, e.Flush(nil)[0].Sum, 0.0)
+}
+
+func BenchmarkCounters_AddParallel(b *testing.B) {
+	b.ReportAllocs()
+	cs := meter.NewCounters(64)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			cs.Add(1, "BAR", "BAZ")
+		}
+	})
+}
+
+func BenchmarkCounters_AddParallelDistinct(b *testing.B) {
+	b.ReportAllocs()
+	cs := meter.NewCounters(64)
+	var n int64
+	b.RunParallel(func(pb *testing.PB) {
+		bar := strconv.FormatInt(atomic.AddInt64(&n, 1), 10)
+		for pb.Next() {
+			cs.Add(1, bar, "BAZ")
+		}
+	})
+}
+
+func BenchmarkCounters_AddParallelNew(b *testing.B) {
+	b.ReportAllocs()
+	cs := meter.NewCounters(64)
+	var n int64
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			bar := strconv.FormatInt(atomic.AddInt64(&n, 1)%4096, 10)
+			cs.Add(1, bar, "BAZ")
+		}
+	})
+}
+
+func BenchmarkEvent_AddParallelLimits(b *testing.B) {
+	b.ReportAllocs()
+	e := meter.NewEvent("foo", "bar", "baz")
+	e.SetLimits(meter.Limits{MaxSize: 64})
+	var n int64
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			bar := strconv.FormatInt(atomic.AddInt64(&n, 1)%4096, 10)
+			e.Add(1, bar, "BAZ")
+		}
+	})
+}
+
+func Test_CountersParallel(t *testing.T) {
+	cs := meter.NewCounters(64)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				cs.Add(1, strconv.Itoa(j%100), strconv.Itoa(i%2))
+			}
+		}(i)
+	}
+	wg.Wait()
+	AssertEqual(t, cs.Len(), 200)
+	var total int64
+	for _, c := range cs.Flush(nil) {
+		total += c.Count
+	}
+	AssertEqual(t, total, int64(8000))
+}
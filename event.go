@@ -1,9 +1,22 @@
 package meter
 
+import (
+	"fmt"
+	"sync/atomic"
+)
+
 // Event stores counters for an event
 type Event struct {
+	// unknown counts unknown labels, it is first so it is 64-bit aligned for atomic access
+	unknown int64
+
 	Name   string   `json:"name"`
 	Labels []string `json:"labels"`
+	Kind   Kind     `json:"kind,omitempty"`
+	// EmptyValue is the value of labels missing in AddFields and AddMap
+	EmptyValue string `json:"empty,omitempty"`
+	// Strict rejects AddFields and AddMap calls with unknown labels
+	Strict bool `json:"strict,omitempty"`
 	*Counters
 }
 
@@ -18,3 +31,61 @@ func NewEvent(name string, labels ...string) *Event {
 
 	return &e
 }
+
+type errUnknownLabel string
+
+func (label errUnknownLabel) Error() string {
+	return fmt.Sprintf("Unknown label %q", string(label))
+}
+
+// AddFields adds n to the counter matching fields by label
+//
+// Labels missing from fields are set to EmptyValue.
+// Unknown labels are counted and ignored unless the event is Strict.
+func (e *Event) AddFields(n int64, fields Fields) (int64, error) {
+	var buf [8]string
+	values := e.emptyValues(buf[:0])
+	for i := range fields {
+		f := &fields[i]
+		if !e.setValue(values, f.Label, f.Value) && e.Strict {
+			return 0, errUnknownLabel(f.Label)
+		}
+	}
+	return e.Add(n, values...), nil
+}
+
+// AddMap adds n to the counter matching a label to value map
+//
+// Labels missing from m are set to EmptyValue.
+// Unknown labels are counted and ignored unless the event is Strict.
+func (e *Event) AddMap(n int64, m map[string]string) (int64, error) {
+	var buf [8]string
+	values := e.emptyValues(buf[:0])
+	for label, value := range m {
+		if !e.setValue(values, label, value) && e.Strict {
+			return 0, errUnknownLabel(label)
+		}
+	}
+	return e.Add(n, values...), nil
+}
+
+// Unknown returns the number of unknown labels passed to AddFields and AddMap
+func (e *Event) Unknown() int64 {
+	return atomic.LoadInt64(&e.unknown)
+}
+
+func (e *Event) emptyValues(values []string) []string {
+	for range e.Labels {
+		values = append(values, e.EmptyValue)
+	}
+	return values
+}
+
+func (e *Event) setValue(values []string, label, value string) bool {
+	if i := indexOf(e.Labels, label); 0 <= i && i < len(values) {
+		values[i] = value
+		return true
+	}
+	atomic.AddInt64(&e.unknown, 1)
+	return false
+}
@@ -31,3 +31,71 @@ func Test_Event(t *testing.T) {
 	AssertEqual(t, e.Len(), 0)
 	// AssertEqual(t, e.index, map[uint64][]int{})
 }
+
+func BenchmarkEvent_With(b *testing.B) {
+	b.ReportAllocs()
+	e := meter.NewEvent("foo", "bar", "baz")
+	h := e.With("BAR", "BAZ")
+	for i := 0; i <= b.N; i++ {
+		h.Add(1)
+	}
+}
+
+func Test_EventWith(t *testing.T) {
+	e := meter.NewEvent("foo", "bar", "baz")
+	h := e.With("BAR", "BAZ")
+	h.Add(1)
+	e.Add(1, "BAR", "BAZ")
+	AssertEqual(t, e.Flush(nil), meter.Snapshot{{
+		Values: []string{"BAR", "BAZ"},
+		Count:  2,
+	}})
+	e.Pack()
+	AssertEqual(t, e.Len(), 1)
+	AssertEqual(t, h.Add(3), int64(3))
+	e.Add(1, "FOO", "BAZ")
+	AssertSnapshot(t, e.Flush(nil), meter.Snapshot{
+		{Values: []string{"BAR", "BAZ"}, Count: 3},
+		{Values: []string{"FOO", "BAZ"}, Count: 1},
+	})
+	// Released counters are dropped by Pack once all handles are released
+	h2 := e.With("BAR", "BAZ")
+	h.Release()
+	e.Pack()
+	AssertEqual(t, e.Len(), 1)
+	h2.Release()
+	e.Pack()
+	AssertEqual(t, e.Len(), 0)
+}
+
+func BenchmarkEvent_AddFields(b *testing.B) {
+	b.ReportAllocs()
+	e := meter.NewEvent("foo", "bar", "baz")
+	fields := meter.Fields{
+		{Label: "baz", Value: "BAZ"},
+		{Label: "bar", Value: "BAR"},
+	}
+	for i := 0; i <= b.N; i++ {
+		e.AddFields(1, fields)
+	}
+}
+
+func Test_EventAddFields(t *testing.T) {
+	e := meter.NewEvent("foo", "bar", "baz")
+	e.EmptyValue = "*"
+	e.AddFields(1, meter.Fields{
+		{Label: "baz", Value: "BAZ"},
+		{Label: "bar", Value: "BAR"},
+	})
+	e.AddMap(1, map[string]string{"bar": "BAR", "baz": "BAZ", "qux": "QUX"})
+	e.AddMap(1, map[string]string{"baz": "BAZ"})
+	AssertEqual(t, e.Unknown(), int64(1))
+	e.Strict = true
+	_, err := e.AddFields(1, meter.Fields{{Label: "qux", Value: "QUX"}})
+	Assert(t, err != nil, "Unknown label accepted")
+	AssertEqual(t, e.Unknown(), int64(2))
+	AssertSnapshot(t, e.Flush(nil), meter.Snapshot{
+		{Values: []string{"BAR", "BAZ"}, Count: 2},
+		{Values: []string{"*", "BAZ"}, Count: 1},
+	})
+}
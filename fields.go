@@ -226,3 +226,26 @@ next:
 	return len(match) == 0
 
 }
+
+// without returns a copy of fields without label
+func (fields Fields) without(label string) Fields {
+	out := make([]Field, 0, len(fields))
+	for i := range fields {
+		if f := &fields[i]; f.Label != label {
+			out = append(out, *f)
+		}
+	}
+	return out
+}
+
+// set sets the value of label in place appending a new field if needed
+func (fields Fields) set(label, value string) Fields {
+	for i := range fields {
+		f := &fields[i]
+		if f.Label == label {
+			f.Value = value
+			return fields
+		}
+	}
+	return append(fields, Field{Label: label, Value: value})
+}
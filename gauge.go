@@ -0,0 +1,116 @@
+package meter
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// Kind is the kind of values an Event records
+type Kind uint8
+
+// Event kinds
+const (
+	// CounterKind events count occurrences
+	CounterKind Kind = iota
+	// GaugeKind events aggregate sampled values per flush
+	GaugeKind
+)
+
+func (k Kind) String() string {
+	switch k {
+	case CounterKind:
+		return "counter"
+	case GaugeKind:
+		return "gauge"
+	default:
+		return "invalid"
+	}
+}
+
+// KindFromString converts a string to Kind
+func KindFromString(s string) (Kind, bool) {
+	switch s {
+	case "counter", "":
+		return CounterKind, true
+	case "gauge":
+		return GaugeKind, true
+	default:
+		return 0, false
+	}
+}
+
+// MarshalText implements encoding.TextMarshaler interface
+func (k Kind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler interface
+func (k *Kind) UnmarshalText(data []byte) error {
+	kind, ok := KindFromString(string(data))
+	if !ok {
+		return errors.New("Invalid kind")
+	}
+	*k = kind
+	return nil
+}
+
+// NewGauge creates a new gauge Event using the specified labels
+//
+// Gauge values are recorded with Set and each flushed Counter holds the
+// count, sum, min, max and last value of the samples since the previous flush.
+func NewGauge(name string, labels ...string) *Event {
+	e := NewEvent(name, labels...)
+	e.Kind = GaugeKind
+	return e
+}
+
+// set records a gauge sample
+func (c *Counter) set(v float64) {
+	if atomic.AddInt64(&c.Count, 1) == 1 {
+		c.Min, c.Max = v, v
+	} else {
+		if v < c.Min {
+			c.Min = v
+		}
+		if v > c.Max {
+			c.Max = v
+		}
+	}
+	atomicAddFloat64(&c.Sum, v)
+	c.Last = v
+}
+
+// merge merges the aggregates of other into a counter
+//
+// The last value of other is only used if the counter is empty.
+func (c *Counter) merge(other *Counter) {
+	n := atomic.AddInt64(&c.Count, other.Count) - other.Count
+	atomicAddFloat64(&c.Sum, other.Sum)
+	if other.Count == 0 {
+		return
+	}
+	if n == 0 {
+		c.Min, c.Max, c.Last = other.Min, other.Max, other.Last
+		return
+	}
+	if other.Min < c.Min {
+		c.Min = other.Min
+	}
+	if other.Max > c.Max {
+		c.Max = other.Max
+	}
+}
+
+// Set records a gauge value for a counter matching values
+func (cs *UnsafeCounters) Set(v float64, values ...string) {
+	h := vhash(values)
+	c := cs.findOrCreate(h, values)
+	c.set(v)
+}
+
+// Set records a gauge value for a specific counter
+func (cs *Counters) Set(v float64, values ...string) {
+	s, c := cs.lock(values)
+	c.set(v)
+	s.mu.Unlock()
+}
@@ -0,0 +1,42 @@
+package meter_test
+
+import (
+	"testing"
+
+	meter "github.com/alxarch/go-meter/v2"
+)
+
+func TestGauge(t *testing.T) {
+	g := meter.NewGauge("queue", "name")
+	AssertEqual(t, g.Kind, meter.GaugeKind)
+	g.Set(4, "jobs")
+	g.Set(2, "jobs")
+	g.Set(9, "jobs")
+	g.Set(3, "jobs")
+	s := g.Flush(nil)
+	AssertEqual(t, s, meter.Snapshot{{
+		Values: []string{"jobs"},
+		Count:  4,
+		Sum:    18,
+		Min:    2,
+		Max:    9,
+		Last:   3,
+	}})
+	g.Set(5, "jobs")
+	g.Merge(s)
+	AssertEqual(t, g.Flush(nil), meter.Snapshot{{
+		Values: []string{"jobs"},
+		Count:  5,
+		Sum:    23,
+		Min:    2,
+		Max:    9,
+		Last:   5,
+	}})
+}
+
+func TestKind_UnmarshalText(t *testing.T) {
+	var k meter.Kind
+	AssertNil(t, k.UnmarshalText([]byte("gauge")))
+	AssertEqual(t, k, meter.GaugeKind)
+	Assert(t, k.UnmarshalText([]byte("foo")) != nil, "Invalid kind accepted")
+}
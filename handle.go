@@ -0,0 +1,80 @@
+package meter
+
+import "sync/atomic"
+
+// Handle is a counter bound to specific values
+//
+// Handles avoid hashing and index lookups on hot paths.
+// A Handle remains valid across Flush and Pack until it is released.
+type Handle struct {
+	counter *Counter
+	owner   handleOwner
+}
+
+type handleOwner interface {
+	release(c *Counter)
+}
+
+// Release releases the bound counter so Pack can drop it once it is zero
+//
+// Release must be called once for each With and the Handle must not be used afterwards.
+func (h Handle) Release() {
+	if h.owner != nil {
+		h.owner.release(h.counter)
+	}
+}
+
+// Add adds n to the bound counter
+func (h Handle) Add(n int64) int64 {
+	return atomic.AddInt64(&h.counter.Count, n)
+}
+
+// AddSum adds n to the bound counter and v to its sum
+func (h Handle) AddSum(n int64, v float64) float64 {
+	atomic.AddInt64(&h.counter.Count, n)
+	return atomicAddFloat64(&h.counter.Sum, v)
+}
+
+// Values returns the values of the bound counter
+func (h Handle) Values() []string {
+	return h.counter.Values
+}
+
+// With returns a Handle bound to the counter matching values
+func (cs *UnsafeCounters) With(values ...string) Handle {
+	h := vhash(values)
+	c := cs.findOrCreate(h, values)
+	cs.bind(c)
+	return Handle{counter: c, owner: cs}
+}
+
+// bind increments the number of handles bound to c
+func (cs *UnsafeCounters) bind(c *Counter) {
+	if cs.bound == nil {
+		cs.bound = make(map[*Counter]int)
+	}
+	cs.bound[c]++
+}
+
+func (cs *UnsafeCounters) release(c *Counter) {
+	if n := cs.bound[c]; n > 1 {
+		cs.bound[c] = n - 1
+	} else {
+		delete(cs.bound, c)
+	}
+}
+
+// With returns a Handle bound to the counter matching values
+func (cs *Counters) With(values ...string) Handle {
+	s, c := cs.lock(values)
+	s.counters.bind(c)
+	s.mu.Unlock()
+	return Handle{counter: c, owner: cs}
+}
+
+func (cs *Counters) release(c *Counter) {
+	s := cs.shard(vhash(c.Values))
+	s.mu.Lock()
+	s.counters.release(c)
+	s.mu.Unlock()
+}
@@ -0,0 +1,270 @@
+package meter
+
+import (
+	"math"
+	"sort"
+	"strconv"
+)
+
+// BucketLabel is the label holding the upper bound of a histogram bucket
+const BucketLabel = "le"
+
+// Histogram counts observed values in buckets with fixed upper bounds
+//
+// Bucket counts are stored as regular counters with an extra BucketLabel
+// so they can be flushed, stored and compacted as any other Event.
+// Quantiles assume the first bucket starts at zero if its bound is positive,
+// so negative values can only be observed if the first bound is not positive.
+type Histogram struct {
+	*Event
+	Buckets []float64
+	bounds  []string
+}
+
+// NewHistogram creates a new Histogram using the specified bucket upper bounds and labels
+func NewHistogram(name string, buckets []float64, labels ...string) *Histogram {
+	buckets = normalizeBuckets(buckets)
+	bounds := make([]string, len(buckets)+1)
+	for i, b := range buckets {
+		bounds[i] = formatBound(b)
+	}
+	bounds[len(buckets)] = formatBound(math.Inf(1))
+	// Copy labels so appending BucketLabel does not modify the caller's slice
+	eventLabels := make([]string, 0, len(labels)+1)
+	eventLabels = append(eventLabels, labels...)
+	eventLabels = append(eventLabels, BucketLabel)
+	return &Histogram{
+		Event:   NewEvent(name, eventLabels...),
+		Buckets: buckets,
+		bounds:  bounds,
+	}
+}
+
+// Observe records a value in the bucket matching v
+//
+// The sum of observed values is also recorded so averages can be queried.
+// NaN values and negative values of histograms with a positive first bound are ignored.
+func (h *Histogram) Observe(v float64, values ...string) {
+	if math.IsNaN(v) || v < 0 && (len(h.Buckets) == 0 || h.Buckets[0] > 0) {
+		return
+	}
+	i := sort.SearchFloat64s(h.Buckets, v)
+	var buf [8]string
+	n := len(h.Labels) - 1
+	vs := buf[:0]
+	if n > len(buf) {
+		vs = make([]string, 0, n+1)
+	}
+	vs = append(vs, values...)
+	for len(vs) < n {
+		vs = append(vs, "")
+	}
+	vs = append(vs[:n], h.bounds[i])
+	h.AddSum(1, v, vs...)
+}
+
+func normalizeBuckets(buckets []float64) []float64 {
+	bs := make([]float64, 0, len(buckets))
+	for _, b := range buckets {
+		if math.IsNaN(b) || math.IsInf(b, 1) {
+			continue
+		}
+		bs = append(bs, b)
+	}
+	sort.Float64s(bs)
+	j := 0
+	for i, b := range bs {
+		if i == 0 || b != bs[j-1] {
+			bs[j] = b
+			j++
+		}
+	}
+	return bs[:j]
+}
+
+func formatBound(b float64) string {
+	if math.IsInf(b, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(b, 'g', -1, 64)
+}
+
+func parseBound(s string) (float64, bool) {
+	if s == "+Inf" {
+		return math.Inf(1), true
+	}
+	b, err := strconv.ParseFloat(s, 64)
+	return b, err == nil
+}
+
+// LinearBuckets creates count buckets of equal width starting at start
+func LinearBuckets(start, width float64, count int) []float64 {
+	buckets := make([]float64, count)
+	for i := range buckets {
+		buckets[i] = start + float64(i)*width
+	}
+	return buckets
+}
+
+// ExponentialBuckets creates count buckets where each bound is factor times the previous one
+func ExponentialBuckets(start, factor float64, count int) []float64 {
+	buckets := make([]float64, count)
+	for i := range buckets {
+		buckets[i] = start
+		start *= factor
+	}
+	return buckets
+}
+
+// QuantilePoint holds the quantiles of a histogram at a specific time
+type QuantilePoint struct {
+	Timestamp int64   `json:"t"`
+	Count     int64   `json:"n"`
+	P50       float64 `json:"p50"`
+	P90       float64 `json:"p90"`
+	P99       float64 `json:"p99"`
+}
+
+// QuantileResult is a query result presented as histogram quantiles
+type QuantileResult struct {
+	Event  string          `json:"event"`
+	Fields Fields          `json:"fields,omitempty"`
+	Data   []QuantilePoint `json:"data,omitempty"`
+}
+
+// QuantileResults is a slice of QuantileResult
+type QuantileResults []QuantileResult
+
+type bucketCount struct {
+	Bound float64
+	Count int64
+}
+
+type bucketCounts []bucketCount
+
+func (bc bucketCounts) Len() int           { return len(bc) }
+func (bc bucketCounts) Swap(i, j int)      { bc[i], bc[j] = bc[j], bc[i] }
+func (bc bucketCounts) Less(i, j int) bool { return bc[i].Bound < bc[j].Bound }
+
+func (bc bucketCounts) add(bound float64, n int64) bucketCounts {
+	for i := range bc {
+		b := &bc[i]
+		if b.Bound == bound {
+			b.Count += n
+			return bc
+		}
+	}
+	return append(bc, bucketCount{Bound: bound, Count: n})
+}
+
+// Quantile estimates the q-quantile assuming a linear distribution within each bucket
+//
+// Buckets must be sorted by bound. Counts are per bucket, not cumulative.
+// The first bucket starts at zero if its bound is positive, otherwise its bound is the estimate.
+func (bc bucketCounts) Quantile(q float64) float64 {
+	var total int64
+	for i := range bc {
+		total += bc[i].Count
+	}
+	if total == 0 {
+		return math.NaN()
+	}
+	rank := q * float64(total)
+	var (
+		cum   int64
+		lower float64
+	)
+	for i := range bc {
+		b := &bc[i]
+		if b.Count > 0 && float64(cum+b.Count) >= rank {
+			if math.IsInf(b.Bound, 1) {
+				// Highest finite bound is the best estimate for the overflow bucket
+				return lower
+			}
+			if i == 0 && b.Bound <= 0 {
+				// No lower bound to interpolate from
+				return b.Bound
+			}
+			return lower + (b.Bound-lower)*(rank-float64(cum))/float64(b.Count)
+		}
+		cum += b.Count
+		lower = b.Bound
+	}
+	return lower
+}
+
+type quantileSeries struct {
+	event  string
+	fields Fields
+	ts     []int64
+	counts map[int64]bucketCounts
+}
+
+// Quantiles converts results of Histogram events to p50/p90/p99 quantiles per series and time step
+//
+// Results without a valid BucketLabel field are ignored.
+func (results Results) Quantiles() (qs QuantileResults) {
+	var series []*quantileSeries
+	for i := range results {
+		r := &results[i]
+		le, ok := r.Fields.Get(BucketLabel)
+		if !ok {
+			continue
+		}
+		bound, ok := parseBound(le)
+		if !ok {
+			continue
+		}
+		fields := r.Fields.without(BucketLabel)
+		var s *quantileSeries
+		for _, ss := range series {
+			if ss.event == r.Event && ss.fields.Equal(fields) {
+				s = ss
+				break
+			}
+		}
+		if s == nil {
+			s = &quantileSeries{
+				event:  r.Event,
+				fields: fields,
+				counts: make(map[int64]bucketCounts),
+			}
+			series = append(series, s)
+		}
+		for _, d := range r.Data {
+			bc, ok := s.counts[d.Timestamp]
+			if !ok {
+				s.ts = append(s.ts, d.Timestamp)
+			}
+			s.counts[d.Timestamp] = bc.add(bound, d.Value)
+		}
+	}
+	for _, s := range series {
+		sort.Slice(s.ts, func(i, j int) bool { return s.ts[i] < s.ts[j] })
+		r := QuantileResult{
+			Event:  s.event,
+			Fields: s.fields,
+			Data:   make([]QuantilePoint, 0, len(s.ts)),
+		}
+		for _, ts := range s.ts {
+			bc := s.counts[ts]
+			sort.Sort(bc)
+			var n int64
+			for i := range bc {
+				n += bc[i].Count
+			}
+			if n == 0 {
+				continue
+			}
+			r.Data = append(r.Data, QuantilePoint{
+				Timestamp: ts,
+				Count:     n,
+				P50:       bc.Quantile(0.5),
+				P90:       bc.Quantile(0.9),
+				P99:       bc.Quantile(0.99),
+			})
+		}
+		qs = append(qs, r)
+	}
+	return
+}
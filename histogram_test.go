@@ -0,0 +1,65 @@
+package meter_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	meter "github.com/alxarch/go-meter/v2"
+)
+
+func TestHistogram(t *testing.T) {
+	h := meter.NewHistogram("latency", []float64{10, 50, 100}, "host")
+	AssertEqual(t, h.Labels, []string{"host", meter.BucketLabel})
+	h.Observe(5, "example.org")
+	h.Observe(10, "example.org")
+	h.Observe(42, "example.org")
+	h.Observe(1000, "example.org")
+	// Negative values are ignored if the first bucket starts at zero
+	h.Observe(-1, "example.org")
+	s := h.Flush(nil)
+	AssertSnapshot(t, s, meter.Snapshot{
+		{Values: []string{"example.org", "10"}, Count: 2, Sum: 15},
+		{Values: []string{"example.org", "50"}, Count: 1, Sum: 42},
+		{Values: []string{"example.org", "+Inf"}, Count: 1, Sum: 1000},
+	})
+
+	h = meter.NewHistogram("temperature", []float64{-10, 0, 10})
+	h.Observe(-20)
+	h.Observe(-5)
+	AssertSnapshot(t, h.Flush(nil), meter.Snapshot{
+		{Values: []string{"-10"}, Count: 1, Sum: -20},
+		{Values: []string{"0"}, Count: 1, Sum: -5},
+	})
+}
+
+func TestResults_Quantiles(t *testing.T) {
+	h := meter.NewHistogram("latency", meter.LinearBuckets(10, 10, 10), "host")
+	for i := 0; i < 100; i++ {
+		h.Observe(float64(i)+0.5, "example.org")
+	}
+	m := meter.MemoryStore{Event: "latency"}
+	tm := time.Now()
+	if err := h.SyncTask(&m)(tm); err != nil {
+		t.Fatal(err)
+	}
+	q := meter.Query{
+		TimeRange: meter.TimeRange{
+			Start: tm.Add(-time.Minute),
+			End:   tm.Add(time.Minute),
+		},
+	}
+	results, err := meter.ScanQueryRunner(&m).RunQuery(context.Background(), &q, "latency")
+	if err != nil {
+		t.Fatal(err)
+	}
+	qs := results.Quantiles()
+	AssertEqual(t, len(qs), 1)
+	AssertEqual(t, qs[0].Fields, meter.Fields{{Label: "host", Value: "example.org"}})
+	AssertEqual(t, len(qs[0].Data), 1)
+	p := qs[0].Data[0]
+	AssertEqual(t, p.Count, int64(100))
+	AssertEqual(t, p.P50, 50.0)
+	AssertEqual(t, p.P90, 90.0)
+	AssertEqual(t, p.P99, 99.0)
+}
@@ -0,0 +1,389 @@
+package meter
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ContentTypeLineProtocol is the content type of InfluxDB line protocol
+const ContentTypeLineProtocol = "text/plain; charset=utf-8"
+
+// LineCountField is the name of the line protocol field used as count
+//
+// If a line has no such field its first integer field is used.
+const LineCountField = "count"
+
+// LineValueField is the name of the line protocol field of result aggregates that differ from the count
+const LineValueField = "value"
+
+// LineError is an error parsing a line of line protocol
+type LineError struct {
+	Line int
+	Err  error
+}
+
+func (e *LineError) Error() string {
+	return fmt.Sprintf("Line %d: %s", e.Line, e.Err)
+}
+
+// Unwrap returns the parse error
+func (e *LineError) Unwrap() error {
+	return e.Err
+}
+
+// LineErrors are the errors of all invalid lines
+type LineErrors []*LineError
+
+func (errs LineErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// ParsePrecision parses the precision of line protocol timestamps
+//
+// Both InfluxDB v1 and v2 names are accepted, an empty string means nanoseconds.
+func ParsePrecision(s string) (time.Duration, error) {
+	switch s {
+	case "", "n", "ns":
+		return time.Nanosecond, nil
+	case "u", "us":
+		return time.Microsecond, nil
+	case "ms":
+		return time.Millisecond, nil
+	case "s":
+		return time.Second, nil
+	case "m":
+		return time.Minute, nil
+	case "h":
+		return time.Hour, nil
+	default:
+		return 0, errors.New("Invalid precision " + strconv.Quote(s))
+	}
+}
+
+// ParseLineProtocol converts InfluxDB line protocol to StoreRequests
+//
+// The measurement is the event, tags are labels and an integer field is the count.
+// A count field may also be a whole number float.
+// Timestamps are in precision units and are truncated to seconds, lines without one use tm.
+// Lines of the same event, tag keys and second are grouped in one request.
+// Valid lines are returned along with LineErrors for invalid lines.
+func ParseLineProtocol(r io.Reader, precision time.Duration, tm time.Time) ([]StoreRequest, error) {
+	var (
+		groups requestGroups
+		errs   LineErrors
+	)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for n := 1; scanner.Scan(); n++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		p, err := parseLine(line, precision, tm)
+		if err != nil {
+			errs = append(errs, &LineError{Line: n, Err: err})
+			continue
+		}
+		sort.Sort(p.tags)
+		groups.add(p.event, p.time, p.tags, p.count)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(errs) > 0 {
+		return groups.reqs, errs
+	}
+	return groups.reqs, nil
+}
+
+type linePoint struct {
+	event string
+	tags  Fields
+	count int64
+	time  time.Time
+}
+
+var (
+	errLineMeasurement = errors.New("Missing measurement")
+	errLineTag         = errors.New("Invalid tag")
+	errLineField       = errors.New("Invalid field")
+	errLineCount       = errors.New("No integer count field")
+	errLineTimestamp   = errors.New("Invalid timestamp")
+)
+
+// parseLine parses a line of line protocol
+func parseLine(line []byte, precision time.Duration, tm time.Time) (p linePoint, err error) {
+	var delim byte
+	p.event, line, delim = scanLineToken(line, ", ")
+	if p.event == "" {
+		return p, errLineMeasurement
+	}
+	for delim == ',' {
+		var f Field
+		f.Label, line, delim = scanLineToken(line, "=")
+		if delim != '=' || f.Label == "" {
+			return p, errLineTag
+		}
+		f.Value, line, delim = scanLineToken(line, ", ")
+		if f.Value == "" {
+			return p, errLineTag
+		}
+		p.tags = append(p.tags, f)
+	}
+	if delim != ' ' {
+		return p, errLineField
+	}
+	var (
+		name  string
+		value []byte
+		found bool
+	)
+	for {
+		line = bytes.TrimLeft(line, " ")
+		name, line, delim = scanLineToken(line, "=")
+		if delim != '=' || name == "" {
+			return p, errLineField
+		}
+		value, line = scanLineFieldValue(line)
+		if len(value) == 0 {
+			return p, errLineField
+		}
+		n, isInt := parseLineInt(value)
+		switch {
+		case name == LineCountField:
+			if !isInt {
+				// Whole number floats are valid counts
+				f, err := strconv.ParseFloat(string(value), 64)
+				if err != nil || f != math.Trunc(f) || math.Abs(f) > math.MaxInt64 {
+					return p, errLineCount
+				}
+				n = int64(f)
+			}
+			p.count, found = n, true
+		case isInt && !found:
+			p.count, found = n, true
+		}
+		if len(line) == 0 || line[0] != ',' {
+			break
+		}
+		line = line[1:]
+	}
+	if !found {
+		return p, errLineCount
+	}
+	p.time = tm
+	if ts := bytes.TrimSpace(line); len(ts) > 0 {
+		n, err := strconv.ParseInt(string(ts), 10, 64)
+		if err != nil {
+			return p, errLineTimestamp
+		}
+		p.time = time.Unix(0, n*int64(precision))
+	}
+	p.time = p.time.Truncate(time.Second)
+	return p, nil
+}
+
+// scanLineToken scans an escaped token up to the first unescaped delimiter
+//
+// The delimiter is zero if the line ended.
+func scanLineToken(line []byte, delims string) (string, []byte, byte) {
+	var b []byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		if c == '\\' && i+1 < len(line) && isLineEscaped(line[i+1]) {
+			if b == nil {
+				b = append(make([]byte, 0, len(line)), line[:i]...)
+			}
+			i++
+			b = append(b, line[i])
+			continue
+		}
+		if strings.IndexByte(delims, c) != -1 {
+			if b == nil {
+				return string(line[:i]), line[i+1:], c
+			}
+			return string(b), line[i+1:], c
+		}
+		if b != nil {
+			b = append(b, c)
+		}
+	}
+	if b == nil {
+		return string(line), nil, 0
+	}
+	return string(b), nil, 0
+}
+
+func isLineEscaped(c byte) bool {
+	switch c {
+	case ',', '=', ' ':
+		return true
+	}
+	return false
+}
+
+// scanLineFieldValue scans a field value up to the next field or the timestamp
+func scanLineFieldValue(line []byte) (value, rest []byte) {
+	if len(line) > 0 && line[0] == '"' {
+		for i := 1; i < len(line); i++ {
+			switch line[i] {
+			case '\\':
+				i++
+			case '"':
+				return line[:i+1], line[i+1:]
+			}
+		}
+		return nil, nil
+	}
+	if i := bytes.IndexAny(line, ", "); i != -1 {
+		return line[:i], line[i:]
+	}
+	return line, nil
+}
+
+// parseLineInt parses integer field values with an 'i' or 'u' suffix
+func parseLineInt(value []byte) (int64, bool) {
+	if len(value) < 2 {
+		return 0, false
+	}
+	switch value[len(value)-1] {
+	case 'i':
+		n, err := strconv.ParseInt(string(value[:len(value)-1]), 10, 64)
+		return n, err == nil
+	case 'u':
+		n, err := strconv.ParseUint(string(value[:len(value)-1]), 10, 63)
+		return int64(n), err == nil
+	}
+	return 0, false
+}
+
+// LineProtocolHandler returns an HTTP endpoint storing InfluxDB line protocol to an EventStore
+//
+// Timestamp precision is set by the precision query parameter.
+// Requests are validated like StoreHandler. If any line is invalid the valid lines
+// are stored and the line errors are returned with a 400 status.
+func LineProtocolHandler(s EventStore) http.HandlerFunc {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		precision, err := ParsePrecision(r.URL.Query().Get("precision"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		reqs, err := ParseLineProtocol(r.Body, precision, time.Now())
+		var lineErrs LineErrors
+		if err != nil && !errors.As(err, &lineErrs) {
+			code := http.StatusBadRequest
+			http.Error(w, http.StatusText(code), code)
+			return
+		}
+		ctx := r.Context()
+		for i := range reqs {
+			if !allow(ctx, ScopeWrite, reqs[i].Event) {
+				code := http.StatusForbidden
+				http.Error(w, http.StatusText(code), code)
+				return
+			}
+		}
+		for i := range reqs {
+			req := &reqs[i]
+			req.addCertField(ctx)
+			if err := s.Store(req); err != nil && !errors.Is(err, ErrDuplicate) {
+				code := http.StatusInternalServerError
+				http.Error(w, http.StatusText(code), code)
+				return
+			}
+		}
+		if len(lineErrs) > 0 {
+			http.Error(w, lineErrs.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+	return InflateRequest(http.HandlerFunc(handler))
+}
+
+// AppendLineProtocol appends results in InfluxDB line protocol
+//
+// Each data point is a line with the event as measurement, fields as tags and an integer count field.
+// A float value field is added if the aggregate of a point differs from its count.
+// Results without data points are written without a timestamp.
+// Timestamps are written in precision units.
+func (results Results) AppendLineProtocol(b []byte, precision time.Duration) []byte {
+	for i := range results {
+		r := &results[i]
+		fields := r.Fields.Sorted()
+		if len(r.Data) == 0 {
+			b = appendLinePoint(b, r.Event, fields, r.Total, r.Aggregate)
+			b = append(b, '\n')
+			continue
+		}
+		for j := range r.Data {
+			d := &r.Data[j]
+			b = appendLinePoint(b, r.Event, fields, d.Value, d.Aggregate)
+			b = append(b, ' ')
+			b = strconv.AppendInt(b, time.Unix(d.Timestamp, 0).UnixNano()/int64(precision), 10)
+			b = append(b, '\n')
+		}
+	}
+	return b
+}
+
+func appendLinePoint(b []byte, event string, fields Fields, n int64, v float64) []byte {
+	b = appendLineEscaped(b, event, false)
+	for _, f := range fields {
+		if f.Value == "" {
+			// Empty tag values are not valid
+			continue
+		}
+		b = append(b, ',')
+		b = appendLineEscaped(b, f.Label, true)
+		b = append(b, '=')
+		b = appendLineEscaped(b, f.Value, true)
+	}
+	b = append(b, ' ')
+	b = append(b, LineCountField...)
+	b = append(b, '=')
+	b = strconv.AppendInt(b, n, 10)
+	b = append(b, 'i')
+	if v != float64(n) {
+		b = append(b, ',')
+		b = append(b, LineValueField...)
+		b = append(b, '=')
+		b = strconv.AppendFloat(b, v, 'f', -1, 64)
+	}
+	return b
+}
+
+func appendLineEscaped(b []byte, s string, tag bool) []byte {
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case ',', ' ':
+			b = append(b, '\\', c)
+		case '=':
+			if tag {
+				b = append(b, '\\')
+			}
+			b = append(b, c)
+		case '\n':
+			// Newlines cannot be escaped
+			b = append(b, '\\', ' ')
+		default:
+			b = append(b, c)
+		}
+	}
+	return b
+}
@@ -0,0 +1,131 @@
+package meter_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	meter "github.com/alxarch/go-meter/v2"
+)
+
+func TestParseLineProtocol(t *testing.T) {
+	now := time.Unix(1500000000, 500)
+	body := strings.Join([]string{
+		"# comment",
+		`requests,status=200,host=a\ b count=3i,latency=1.5 1500000060500000000`,
+		`requests,host=a\ b,status=500 count=1i 1500000060900000000`,
+		`jobs,queue=q\,1 msg="a \"quoted\" value, with comma",n=2u`,
+		"requests,status=200 count=1.5",
+		"requests,status=200,host=c count=2 1500000060000000000",
+		"requests,status= count=1i",
+		"requests count=1i notatimestamp",
+		"",
+	}, "\n")
+	reqs, err := meter.ParseLineProtocol(strings.NewReader(body), time.Nanosecond, now)
+	var lineErrs meter.LineErrors
+	Assert(t, errors.As(err, &lineErrs), "Invalid error %v", err)
+	AssertEqual(t, len(lineErrs), 3)
+	AssertEqual(t, lineErrs[0].Line, 5)
+	AssertEqual(t, lineErrs[1].Line, 7)
+	AssertEqual(t, lineErrs[2].Line, 8)
+
+	AssertEqual(t, len(reqs), 2)
+	r := reqs[0]
+	AssertEqual(t, r.Event, "requests")
+	AssertEqual(t, r.Time, time.Unix(1500000060, 0))
+	AssertEqual(t, r.Labels, []string{"host", "status"})
+	AssertSnapshot(t, r.Counters, meter.Snapshot{
+		{Values: []string{"a b", "200"}, Count: 3},
+		{Values: []string{"a b", "500"}, Count: 1},
+		{Values: []string{"c", "200"}, Count: 2},
+	})
+	r = reqs[1]
+	AssertEqual(t, r.Event, "jobs")
+	AssertEqual(t, r.Time, time.Unix(1500000000, 0))
+	AssertEqual(t, r.Labels, []string{"queue"})
+	AssertSnapshot(t, r.Counters, meter.Snapshot{{Values: []string{"q,1"}, Count: 2}})
+}
+
+func TestLineProtocolHandler(t *testing.T) {
+	db := &testStore{}
+	h := meter.LineProtocolHandler(db)
+	post := func(url, body string) int {
+		t.Helper()
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, url, strings.NewReader(body))
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	AssertEqual(t, post("/write?precision=s", "foo,color=red count=2i 1500000000\nfoo,color=blue n=1i 1500000000\n"), http.StatusNoContent)
+	AssertEqual(t, post("/write?precision=s", "foo,color=red count=1i 1500000001\nfoo count=\n"), http.StatusBadRequest)
+	AssertEqual(t, post("/write?precision=x", "foo count=1i"), http.StatusBadRequest)
+	AssertEqual(t, len(db.data), 2)
+	AssertEqual(t, db.data[0].Time, time.Unix(1500000000, 0))
+	AssertSnapshot(t, db.data[0].Counters, meter.Snapshot{
+		{Values: []string{"red"}, Count: 2},
+		{Values: []string{"blue"}, Count: 1},
+	})
+	AssertEqual(t, db.data[1].Time, time.Unix(1500000001, 0))
+}
+
+func TestResults_AppendLineProtocol(t *testing.T) {
+	results := meter.Results{
+		{
+			Event:     "foo bar",
+			Fields:    meter.Fields{{Label: "b", Value: "x,y"}, {Label: "a", Value: "1"}, {Label: "c"}},
+			Total:     3,
+			Aggregate: 3,
+			Data:      []meter.DataPoint{{Timestamp: 1500000000, Value: 1, Aggregate: 1}, {Timestamp: 1500000060, Value: 2, Aggregate: 2}},
+		},
+		{
+			Event:     "baz",
+			Total:     2,
+			Aggregate: 2,
+		},
+	}
+	out := string(results.AppendLineProtocol(nil, time.Second))
+	AssertEqual(t, out, `foo\ bar,a=1,b=x\,y count=1i 1500000000
+foo\ bar,a=1,b=x\,y count=2i 1500000060
+baz count=2i
+`)
+	results[1].Aggregate = 2.5
+	results[1].Fields = meter.Fields{{Label: "host", Value: "a\nb"}}
+	out = string(results.AppendLineProtocol(nil, time.Millisecond))
+	AssertEqual(t, out, `foo\ bar,a=1,b=x\,y count=1i 1500000000000
+foo\ bar,a=1,b=x\,y count=2i 1500000060000
+baz,host=a\ b count=2i,value=2.5
+`)
+
+	// Round trip
+	reqs, err := meter.ParseLineProtocol(strings.NewReader(out), time.Millisecond, time.Now())
+	AssertNil(t, err)
+	AssertEqual(t, len(reqs), 3)
+	AssertEqual(t, reqs[1].Event, "foo bar")
+	AssertEqual(t, reqs[1].Time, time.Unix(1500000060, 0))
+	AssertEqual(t, reqs[1].Labels, []string{"a", "b"})
+	AssertSnapshot(t, reqs[1].Counters, meter.Snapshot{{Values: []string{"1", "x,y"}, Count: 2}})
+	AssertSnapshot(t, reqs[2].Counters, meter.Snapshot{{Values: []string{"a b"}, Count: 2}})
+}
+
+type resultsRunner meter.Results
+
+func (r resultsRunner) RunQuery(ctx context.Context, q *meter.Query, events ...string) (meter.Results, error) {
+	return meter.Results(r), nil
+}
+
+func TestQueryHandler_Influx(t *testing.T) {
+	h := meter.QueryHandler(resultsRunner{
+		{Event: "foo", Total: 3, Aggregate: 3, Data: []meter.DataPoint{{Timestamp: 60, Value: 3, Aggregate: 3}}},
+	})
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/?event=foo&format=influx&precision=s", nil))
+	AssertEqual(t, w.Code, http.StatusOK)
+	AssertEqual(t, w.Body.String(), "foo count=3i 60\n")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/?event=foo&format=influx&results=totals", nil))
+	AssertEqual(t, w.Body.String(), "foo count=3i\n")
+}
@@ -0,0 +1,182 @@
+package meter
+
+// DefaultOverflowValue is the value used for values over cardinality limits
+const DefaultOverflowValue = "__other__"
+
+// Limits are cardinality limits for the values of an Event
+type Limits struct {
+	// MaxSize is the max number of distinct value combinations including the overflow row
+	MaxSize int `json:"max_size,omitempty"`
+	// MaxValues is the max number of distinct values of each label
+	MaxValues int `json:"max_values,omitempty"`
+	// LabelValues overrides MaxValues for specific labels
+	LabelValues map[string]int `json:"label_values,omitempty"`
+	// Overflow is the value used for values over the limits
+	Overflow string `json:"overflow,omitempty"`
+}
+
+// SetLimits sets cardinality limits for an Event
+//
+// Values over the limits are replaced with the overflow value.
+// Rejected value combinations are remembered so that adding them again does not
+// take the limits write lock, and they keep being replaced after Pack frees slots
+// for new values. A zero Limits value removes all limits.
+func (e *Event) SetLimits(limits Limits) {
+	if limits.MaxSize <= 0 && limits.MaxValues <= 0 && len(limits.LabelValues) == 0 {
+		e.Counters.setLimits(nil)
+		return
+	}
+	l := counterLimits{
+		maxSize:   limits.MaxSize,
+		maxValues: make([]int, len(e.Labels)),
+		value:     limits.Overflow,
+		overflow:  make([]string, len(e.Labels)),
+	}
+	if l.value == "" {
+		l.value = DefaultOverflowValue
+	}
+	for i, label := range e.Labels {
+		n, ok := limits.LabelValues[label]
+		if !ok {
+			n = limits.MaxValues
+		}
+		l.maxValues[i] = n
+		l.overflow[i] = l.value
+	}
+	e.Counters.setLimits(&l)
+}
+
+// maxRejectedValues is the max number of rejected value combinations remembered by limits
+const maxRejectedValues = 1 << 16
+
+type counterLimits struct {
+	maxSize   int
+	maxValues []int
+	value     string
+	// overflow are the values of the overflow row
+	overflow []string
+	distinct []map[string]struct{}
+	// rejected maps hashes of rejected values to their replacements
+	rejected map[uint64][]rejectedValues
+	size     int
+	dropped  int64
+}
+
+type rejectedValues struct {
+	values  []string
+	replace []string
+}
+
+func (l *counterLimits) reset(counters []*Counter) {
+	l.distinct = make([]map[string]struct{}, len(l.maxValues))
+	for _, c := range counters {
+		l.record(c.Values)
+	}
+}
+
+func (l *counterLimits) record(values []string) {
+	for i, v := range values {
+		if 0 <= i && i < len(l.distinct) {
+			if l.distinct[i] == nil {
+				l.distinct[i] = make(map[string]struct{})
+			}
+			l.distinct[i][v] = struct{}{}
+		}
+	}
+}
+
+// replacement returns the replacement of rejected values or nil
+func (l *counterLimits) replacement(h uint64, values []string) []string {
+	for _, r := range l.rejected[h] {
+		if stringsEqual(r.values, values) {
+			return r.replace
+		}
+	}
+	return nil
+}
+
+// reject remembers the replacement of rejected values
+//
+// Once maxRejectedValues are remembered all are forgotten.
+func (l *counterLimits) reject(h uint64, values, replace []string) {
+	if l.rejected == nil || l.size >= maxRejectedValues {
+		l.rejected = make(map[uint64][]rejectedValues)
+		l.size = 0
+	}
+	l.rejected[h] = append(l.rejected[h], rejectedValues{
+		values:  vdeepcopy(values),
+		replace: replace,
+	})
+	l.size++
+}
+
+// apply replaces values over the limits with the overflow value
+//
+// It returns a modified copy of values if any value was over the limits.
+// The last slot of maxSize is reserved for the overflow row.
+func (l *counterLimits) apply(values []string, size int) ([]string, bool) {
+	if l.maxSize > 0 && size >= l.maxSize-1 {
+		overflow := l.overflow
+		if len(values) != len(overflow) {
+			overflow = make([]string, len(values))
+			for i := range overflow {
+				overflow[i] = l.value
+			}
+		}
+		if stringsEqual(values, overflow) {
+			return values, false
+		}
+		return overflow, true
+	}
+	var out []string
+	for i, v := range values {
+		if i >= len(l.maxValues) || v == l.value {
+			continue
+		}
+		max := l.maxValues[i]
+		if max <= 0 {
+			continue
+		}
+		distinct := l.distinct[i]
+		if _, ok := distinct[v]; ok || len(distinct) < max {
+			continue
+		}
+		if out == nil {
+			out = make([]string, len(values))
+			copy(out, values)
+		}
+		out[i] = l.value
+	}
+	if out == nil {
+		return values, false
+	}
+	return out, true
+}
+
+// Dropped returns the number of distinct value combinations replaced due to cardinality limits
+//
+// Combinations rejected again after the remembered ones are forgotten are counted again.
+func (cs *Counters) Dropped() (n int64) {
+	cs.lmu.RLock()
+	if l := cs.limits; l != nil {
+		n = l.dropped
+	}
+	cs.lmu.RUnlock()
+	return
+}
+
+func (cs *Counters) setLimits(l *counterLimits) {
+	var counters []*Counter
+	for i := range cs.shards {
+		s := &cs.shards[i]
+		s.mu.RLock()
+		counters = append(counters, s.counters.counters...)
+		s.mu.RUnlock()
+	}
+	cs.lmu.Lock()
+	if l != nil {
+		l.reset(counters)
+	}
+	cs.limits = l
+	cs.lmu.Unlock()
+}
@@ -0,0 +1,67 @@
+package meter_test
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	meter "github.com/alxarch/go-meter/v2"
+)
+
+func TestEvent_SetLimits(t *testing.T) {
+	e := meter.NewEvent("requests", "method", "path")
+	e.SetLimits(meter.Limits{
+		MaxSize: 4,
+		LabelValues: map[string]int{
+			"path": 2,
+		},
+	})
+	e.Add(1, "GET", "/foo")
+	e.Add(1, "GET", "/bar")
+	e.Add(1, "GET", "/baz")
+	e.Add(1, "POST", "/foo")
+	e.Add(1, "POST", "/qux")
+	e.Add(1, "PUT", "/foo")
+	e.Add(1, "PUT", "/bar")
+	AssertEqual(t, e.Len(), 4)
+	AssertEqual(t, e.Dropped(), int64(5))
+	s := e.Flush(nil)
+	AssertSnapshot(t, s, meter.Snapshot{
+		{Values: []string{"GET", "/foo"}, Count: 1},
+		{Values: []string{"GET", "/bar"}, Count: 1},
+		{Values: []string{"GET", meter.DefaultOverflowValue}, Count: 1},
+		{Values: []string{meter.DefaultOverflowValue, meter.DefaultOverflowValue}, Count: 4},
+	})
+
+	// Rejected values are dropped once and stay rejected after Pack frees slots
+	e.Add(1, "PUT", "/bar")
+	AssertEqual(t, e.Dropped(), int64(5))
+	e.Flush(nil)
+	e.Pack()
+	AssertEqual(t, e.Len(), 0)
+	e.Add(1, "PUT", "/bar")
+	e.Add(1, "GET", "/qux")
+	AssertEqual(t, e.Dropped(), int64(5))
+	AssertSnapshot(t, e.Flush(nil), meter.Snapshot{
+		{Values: []string{meter.DefaultOverflowValue, meter.DefaultOverflowValue}, Count: 1},
+		{Values: []string{"GET", "/qux"}, Count: 1},
+	})
+}
+
+func TestEvent_SetLimits_Concurrent(t *testing.T) {
+	e := meter.NewEvent("requests", "path")
+	e.SetLimits(meter.Limits{MaxSize: 10})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				e.Add(1, strconv.Itoa(i*100+j))
+			}
+		}(i)
+	}
+	wg.Wait()
+	AssertEqual(t, e.Len(), 10)
+	AssertEqual(t, e.Dropped(), int64(800-9))
+}
@@ -3,6 +3,7 @@ package meter_test
 import (
 	"reflect"
 	"sort"
+	"strings"
 	"testing"
 
 	meter "github.com/alxarch/go-meter/v2"
@@ -17,6 +18,21 @@ func AssertEqual(t *testing.T, a interface{}, b interface{}) {
 		t.Errorf("a != b %v %v", a, b)
 	}
 }
+
+// AssertSnapshot checks if snapshots have equal counters regardless of order
+func AssertSnapshot(t *testing.T, a, b meter.Snapshot) {
+	t.Helper()
+	a = append(meter.Snapshot(nil), a...)
+	b = append(meter.Snapshot(nil), b...)
+	for _, s := range []meter.Snapshot{a, b} {
+		s := s
+		sort.Slice(s, func(i, j int) bool {
+			return strings.Join(s[i].Values, "\x00") < strings.Join(s[j].Values, "\x00")
+		})
+	}
+	AssertEqual(t, a, b)
+}
+
 func Assert(t *testing.T, ok bool, msg string, args ...interface{}) {
 	t.Helper()
 	if !ok {
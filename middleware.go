@@ -0,0 +1,324 @@
+package meter
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Labels of HTTP request events
+const (
+	LabelMethod = "method"
+	LabelRoute  = "route"
+	LabelStatus = "status"
+	LabelHost   = "host"
+)
+
+// DefaultHTTPEvent is the name of events created by NewMiddleware
+const DefaultHTTPEvent = "http_requests"
+
+// DefaultRoute is the route label value of requests if Middleware.Route is nil
+//
+// Raw URL paths are not used as they would create a series per path.
+const DefaultRoute = "*"
+
+// DefaultHost is the host label value of requests to hosts not in Middleware.Hosts
+//
+// Raw Host headers are not used as clients control them.
+const DefaultHost = "*"
+
+// NewHTTPEvent creates an Event with the standard HTTP request labels
+func NewHTTPEvent(name string) *Event {
+	return NewEvent(name, LabelMethod, LabelRoute, LabelStatus, LabelHost)
+}
+
+// Middleware meters HTTP requests into an Event
+//
+// Event labels other than the standard HTTP labels take their values
+// from the request context fields or EmptyValue.
+type Middleware struct {
+	Event *Event
+	// Route names the route of a request, it should return a small set of values
+	Route func(r *http.Request) string
+	// Hosts are the hosts recorded in the host label, matched case insensitively without the port
+	// Requests to other hosts are recorded as DefaultHost.
+	Hosts []string
+	// ResponseSize adds the number of response body bytes to the counter sum
+	ResponseSize bool
+}
+
+// NewMiddleware creates a Middleware for an Event
+//
+// If e is nil an Event named DefaultHTTPEvent with the standard HTTP labels is created.
+// If route is nil the route label is DefaultRoute.
+func NewMiddleware(e *Event, route func(r *http.Request) string) *Middleware {
+	if e == nil {
+		e = NewHTTPEvent(DefaultHTTPEvent)
+	}
+	return &Middleware{
+		Event: e,
+		Route: route,
+	}
+}
+
+// Handler wraps an http.Handler metering all requests
+func (m *Middleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mw := meteredResponseWriter{ResponseWriter: w}
+		done := false
+		defer func() {
+			// Handlers that panic without a status are recorded as 500
+			if !done && mw.code == 0 {
+				mw.code = http.StatusInternalServerError
+			}
+			m.record(r, &mw)
+		}()
+		next.ServeHTTP(mw.wrap(), r)
+		done = true
+	})
+}
+
+func (m *Middleware) record(r *http.Request, w *meteredResponseWriter) {
+	e := m.Event
+	var buf [8]string
+	values := buf[:0]
+	for _, label := range e.Labels {
+		var v string
+		switch label {
+		case LabelMethod:
+			v = r.Method
+		case LabelRoute:
+			if m.Route != nil {
+				v = m.Route(r)
+			} else {
+				v = DefaultRoute
+			}
+		case LabelStatus:
+			v = statusClass(w.Status())
+		case LabelHost:
+			v = m.host(r)
+		default:
+			v = e.contextValue(r.Context(), label)
+		}
+		values = append(values, v)
+	}
+	if m.ResponseSize {
+		e.AddSum(1, float64(w.size), values...)
+		return
+	}
+	e.Add(1, values...)
+}
+
+// host returns the host label value of a request
+func (m *Middleware) host(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(host, ".")
+	for _, h := range m.Hosts {
+		if strings.EqualFold(h, host) {
+			return h
+		}
+	}
+	return DefaultHost
+}
+
+func statusClass(code int) string {
+	if 100 <= code && code < 600 {
+		return strconv.Itoa(code/100) + "xx"
+	}
+	return strconv.Itoa(code)
+}
+
+type meteredResponseWriter struct {
+	http.ResponseWriter
+	code int
+	size int64
+}
+
+// wrap returns a ResponseWriter implementing only the optional interfaces of the wrapped writer
+//
+// Handlers detecting optional interfaces with type assertions get the same answer as without metering.
+func (w *meteredResponseWriter) wrap() http.ResponseWriter {
+	const (
+		flusher = 1 << iota
+		hijacker
+		readerFrom
+		pusher
+	)
+	var flags int
+	if _, ok := w.ResponseWriter.(http.Flusher); ok {
+		flags |= flusher
+	}
+	if _, ok := w.ResponseWriter.(http.Hijacker); ok {
+		flags |= hijacker
+	}
+	if _, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		flags |= readerFrom
+	}
+	if _, ok := w.ResponseWriter.(http.Pusher); ok {
+		flags |= pusher
+	}
+	switch flags {
+	case flusher:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+		}{w, w}
+	case hijacker:
+		return struct {
+			http.ResponseWriter
+			http.Hijacker
+		}{w, w}
+	case flusher | hijacker:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			http.Hijacker
+		}{w, w, w}
+	case readerFrom:
+		return struct {
+			http.ResponseWriter
+			io.ReaderFrom
+		}{w, w}
+	case flusher | readerFrom:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			io.ReaderFrom
+		}{w, w, w}
+	case hijacker | readerFrom:
+		return struct {
+			http.ResponseWriter
+			http.Hijacker
+			io.ReaderFrom
+		}{w, w, w}
+	case flusher | hijacker | readerFrom:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			http.Hijacker
+			io.ReaderFrom
+		}{w, w, w, w}
+	case pusher:
+		return struct {
+			http.ResponseWriter
+			http.Pusher
+		}{w, w}
+	case flusher | pusher:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			http.Pusher
+		}{w, w, w}
+	case hijacker | pusher:
+		return struct {
+			http.ResponseWriter
+			http.Hijacker
+			http.Pusher
+		}{w, w, w}
+	case flusher | hijacker | pusher:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			http.Hijacker
+			http.Pusher
+		}{w, w, w, w}
+	case readerFrom | pusher:
+		return struct {
+			http.ResponseWriter
+			io.ReaderFrom
+			http.Pusher
+		}{w, w, w}
+	case flusher | readerFrom | pusher:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			io.ReaderFrom
+			http.Pusher
+		}{w, w, w, w}
+	case hijacker | readerFrom | pusher:
+		return struct {
+			http.ResponseWriter
+			http.Hijacker
+			io.ReaderFrom
+			http.Pusher
+		}{w, w, w, w}
+	case flusher | hijacker | readerFrom | pusher:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			http.Hijacker
+			io.ReaderFrom
+			http.Pusher
+		}{w, w, w, w, w}
+	default:
+		return struct {
+			http.ResponseWriter
+		}{w}
+	}
+}
+
+// Status returns the status code sent to the client
+func (w *meteredResponseWriter) Status() int {
+	if w.code == 0 {
+		return http.StatusOK
+	}
+	return w.code
+}
+
+func (w *meteredResponseWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *meteredResponseWriter) Write(p []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// Flush implements http.Flusher interface if the wrapped writer does
+//
+// Flushing sends the headers so the status is fixed to 200 if not already set.
+func (w *meteredResponseWriter) Flush() {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	w.ResponseWriter.(http.Flusher).Flush()
+}
+
+// Hijack implements http.Hijacker interface if the wrapped writer does
+//
+// Hijacked connections without a status are recorded as 101 Switching Protocols.
+func (w *meteredResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := w.ResponseWriter.(http.Hijacker).Hijack()
+	if err == nil && w.code == 0 {
+		w.code = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+// ReadFrom implements io.ReaderFrom interface if the wrapped writer does
+func (w *meteredResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	n, err := w.ResponseWriter.(io.ReaderFrom).ReadFrom(r)
+	w.size += n
+	return n, err
+}
+
+// Push implements http.Pusher interface if the wrapped writer does
+func (w *meteredResponseWriter) Push(target string, opts *http.PushOptions) error {
+	return w.ResponseWriter.(http.Pusher).Push(target, opts)
+}
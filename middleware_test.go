@@ -0,0 +1,99 @@
+package meter_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	meter "github.com/alxarch/go-meter/v2"
+)
+
+func TestMiddleware(t *testing.T) {
+	m := meter.NewMiddleware(nil, func(r *http.Request) string {
+		return "/" + r.URL.Query().Get("route")
+	})
+	m.ResponseSize = true
+	m.Hosts = []string{"127.0.0.1"}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	})
+	mux.HandleFunc("/missing", func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	})
+	mux.HandleFunc("/flush", func(w http.ResponseWriter, r *http.Request) {
+		w.(http.Flusher).Flush()
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	mux.HandleFunc("/copy", func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, strings.NewReader("copied"))
+	})
+	mux.HandleFunc("/hijack", func(w http.ResponseWriter, r *http.Request) {
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: close\r\n\r\n")
+		rw.Flush()
+	})
+	srv := httptest.NewServer(m.Handler(mux))
+	defer srv.Close()
+	for _, path := range []string{"ok", "ok", "missing", "flush", "copy", "hijack"} {
+		res, err := http.Get(srv.URL + "/" + path + "?route=" + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+	}
+	host := "127.0.0.1"
+	AssertSnapshot(t, m.Event.Flush(nil), meter.Snapshot{
+		{Values: []string{"GET", "/ok", "2xx", host}, Count: 2, Sum: 4},
+		{Values: []string{"GET", "/missing", "4xx", host}, Count: 1, Sum: 19},
+		{Values: []string{"GET", "/flush", "2xx", host}, Count: 1},
+		{Values: []string{"GET", "/copy", "2xx", host}, Count: 1, Sum: 6},
+		{Values: []string{"GET", "/hijack", "1xx", host}, Count: 1},
+	})
+}
+
+func TestMiddleware_Defaults(t *testing.T) {
+	m := meter.NewMiddleware(nil, nil)
+	h := m.Handler(http.NotFoundHandler())
+	for _, path := range []string{"/foo", "/bar"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+	h = m.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+	func() {
+		defer func() {
+			AssertEqual(t, recover(), http.ErrAbortHandler)
+		}()
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/panic", nil))
+	}()
+	AssertSnapshot(t, m.Event.Flush(nil), meter.Snapshot{
+		{Values: []string{"GET", meter.DefaultRoute, "4xx", meter.DefaultHost}, Count: 2},
+		{Values: []string{"GET", meter.DefaultRoute, "5xx", meter.DefaultHost}, Count: 1},
+	})
+
+	// Only the optional interfaces of the wrapped writer are implemented
+	m.Hosts = []string{"example.com"}
+	h = m.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, flusher := w.(http.Flusher)
+		_, hijacker := w.(http.Hijacker)
+		_, pusher := w.(http.Pusher)
+		Assert(t, flusher && !hijacker && !pusher, "Invalid optional interfaces")
+	}))
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Host = "EXAMPLE.com:8080"
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	AssertSnapshot(t, m.Event.Flush(nil), meter.Snapshot{
+		{Values: []string{"GET", meter.DefaultRoute, "2xx", "example.com"}, Count: 1},
+		{Values: []string{"GET", meter.DefaultRoute, "4xx", meter.DefaultHost}, Count: 0},
+		{Values: []string{"GET", meter.DefaultRoute, "5xx", meter.DefaultHost}, Count: 0},
+	})
+}
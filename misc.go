@@ -2,9 +2,12 @@ package meter
 
 import (
 	"encoding/binary"
+	"math"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unsafe"
 )
 
 func stringsEqual(a, b []string) bool {
@@ -246,3 +249,33 @@ func appendString(dst []byte, s string) []byte {
 	dst = append(dst, s...)
 	return dst
 }
+
+func atomicAddFloat64(p *float64, v float64) float64 {
+	ptr := (*uint64)(unsafe.Pointer(p))
+	for {
+		old := atomic.LoadUint64(ptr)
+		sum := math.Float64frombits(old) + v
+		if atomic.CompareAndSwapUint64(ptr, old, math.Float64bits(sum)) {
+			return sum
+		}
+	}
+}
+
+func atomicLoadFloat64(p *float64) float64 {
+	return math.Float64frombits(atomic.LoadUint64((*uint64)(unsafe.Pointer(p))))
+}
+
+func atomicSwapFloat64(p *float64, v float64) float64 {
+	ptr := (*uint64)(unsafe.Pointer(p))
+	return math.Float64frombits(atomic.SwapUint64(ptr, math.Float64bits(v)))
+}
+
+func appendUvarint(dst []byte, n uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(dst, buf[:binary.PutUvarint(buf[:], n)]...)
+}
+
+func appendVarint(dst []byte, n int64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(dst, buf[:binary.PutVarint(buf[:], n)]...)
+}
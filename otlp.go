@@ -0,0 +1,463 @@
+package meter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OTLPReceiver is an OTLP/HTTP endpoint storing metrics in JSON encoding to an EventStore
+//
+// Monotonic Sum data points are stored as counters of an event named after the metric.
+// Resource and data point attributes are labels, data point attributes override resource attributes.
+// Cumulative sums are converted to deltas. The first point of a series only records its value
+// unless its start time is after the previous export. A changed start time or a decreasing value
+// is a reset. Fractional deltas of both delta and cumulative sums are carried over.
+// Other metric types and points of unknown events are rejected in the partial success response.
+// Points of requests that fail to store are also rejected unless no request was stored,
+// in which case a 503 status is returned so the export can be safely retried.
+// Series not exported within Retention are forgotten and start over.
+type OTLPReceiver struct {
+	// Store is the EventStore data points are stored to
+	Store EventStore
+	// ResourceAttributes are the resource attributes added as labels, "*" adds all
+	ResourceAttributes []string
+	// Retention is the time the state of a series is kept after its last point, defaults to DefaultOTLPRetention
+	Retention time.Duration
+
+	mu   sync.Mutex
+	last map[string]otlpSeries
+	// exported is the time of the previous export in nanoseconds
+	exported int64
+	// pruned is the time series were last pruned in nanoseconds
+	pruned int64
+}
+
+// DefaultOTLPRetention is the default time the state of an OTLP series is kept after its last point
+const DefaultOTLPRetention = time.Hour
+
+// maxOTLPBodySize is the max size of decoded OTLP request bodies
+const maxOTLPBodySize = 32 << 20
+
+// otlpSeries is the state of a series between exports
+//
+// For cumulative sums it is the start time and the value counted so far,
+// for delta sums it is the fraction carried over to the next point.
+// Seen is the time of the export of the last point in nanoseconds.
+type otlpSeries struct {
+	start int64
+	value float64
+	seen  int64
+}
+
+// otlpUpdate is a change of a series undone if its request fails to store
+type otlpUpdate struct {
+	key        string
+	prev, next otlpSeries
+}
+
+// OTLP temporalities of Sum metrics
+const (
+	otlpTemporalityDelta      = 1
+	otlpTemporalityCumulative = 2
+)
+
+type otlpMetricsRequest struct {
+	ResourceMetrics []struct {
+		Resource struct {
+			Attributes otlpAttributes `json:"attributes"`
+		} `json:"resource"`
+		ScopeMetrics []struct {
+			Metrics []otlpMetric `json:"metrics"`
+		} `json:"scopeMetrics"`
+	} `json:"resourceMetrics"`
+}
+
+type otlpMetric struct {
+	Name string `json:"name"`
+	Sum  *struct {
+		DataPoints             []otlpDataPoint `json:"dataPoints"`
+		AggregationTemporality otlpTemporality `json:"aggregationTemporality"`
+		IsMonotonic            bool            `json:"isMonotonic"`
+	} `json:"sum"`
+	Gauge                *otlpDataPoints `json:"gauge"`
+	Histogram            *otlpDataPoints `json:"histogram"`
+	ExponentialHistogram *otlpDataPoints `json:"exponentialHistogram"`
+	Summary              *otlpDataPoints `json:"summary"`
+}
+
+type otlpDataPoints struct {
+	DataPoints []json.RawMessage `json:"dataPoints"`
+}
+
+type otlpDataPoint struct {
+	Attributes        otlpAttributes `json:"attributes"`
+	StartTimeUnixNano otlpInt        `json:"startTimeUnixNano"`
+	TimeUnixNano      otlpInt        `json:"timeUnixNano"`
+	AsInt             *otlpInt       `json:"asInt"`
+	AsDouble          *otlpFloat     `json:"asDouble"`
+}
+
+type otlpAttributes []struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string         `json:"stringValue"`
+	BoolValue   *bool           `json:"boolValue"`
+	IntValue    *otlpInt        `json:"intValue"`
+	DoubleValue *otlpFloat      `json:"doubleValue"`
+	ArrayValue  json.RawMessage `json:"arrayValue"`
+	KvlistValue json.RawMessage `json:"kvlistValue"`
+	BytesValue  *string         `json:"bytesValue"`
+}
+
+func (v *otlpAnyValue) String() string {
+	switch {
+	case v.StringValue != nil:
+		return *v.StringValue
+	case v.BoolValue != nil:
+		return strconv.FormatBool(*v.BoolValue)
+	case v.IntValue != nil:
+		return strconv.FormatInt(int64(*v.IntValue), 10)
+	case v.DoubleValue != nil:
+		return strconv.FormatFloat(float64(*v.DoubleValue), 'f', -1, 64)
+	case v.BytesValue != nil:
+		return *v.BytesValue
+	case v.ArrayValue != nil:
+		return string(v.ArrayValue)
+	case v.KvlistValue != nil:
+		return string(v.KvlistValue)
+	default:
+		return ""
+	}
+}
+
+// otlpInt is a 64-bit integer encoded either as a JSON number or a string
+type otlpInt int64
+
+func (n *otlpInt) UnmarshalJSON(data []byte) error {
+	v, err := strconv.ParseInt(strings.Trim(string(data), `"`), 10, 64)
+	if err != nil {
+		return err
+	}
+	*n = otlpInt(v)
+	return nil
+}
+
+// otlpFloat is a double encoded either as a JSON number or a string
+type otlpFloat float64
+
+func (f *otlpFloat) UnmarshalJSON(data []byte) error {
+	s := strings.Trim(string(data), `"`)
+	switch s {
+	case "NaN":
+		*f = otlpFloat(math.NaN())
+	case "Infinity":
+		*f = otlpFloat(math.Inf(1))
+	case "-Infinity":
+		*f = otlpFloat(math.Inf(-1))
+	default:
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		*f = otlpFloat(v)
+	}
+	return nil
+}
+
+// otlpTemporality is an aggregation temporality encoded either as a number or an enum name
+type otlpTemporality int
+
+func (t *otlpTemporality) UnmarshalJSON(data []byte) error {
+	switch s := string(data); s {
+	case `"AGGREGATION_TEMPORALITY_DELTA"`:
+		*t = otlpTemporalityDelta
+	case `"AGGREGATION_TEMPORALITY_CUMULATIVE"`:
+		*t = otlpTemporalityCumulative
+	case `"AGGREGATION_TEMPORALITY_UNSPECIFIED"`:
+		*t = 0
+	default:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		*t = otlpTemporality(n)
+	}
+	return nil
+}
+
+// OTLPResponse is the response of an OTLPReceiver
+type OTLPResponse struct {
+	PartialSuccess *OTLPPartialSuccess `json:"partialSuccess,omitempty"`
+}
+
+// OTLPPartialSuccess reports rejected data points
+type OTLPPartialSuccess struct {
+	RejectedDataPoints int64  `json:"rejectedDataPoints,string"`
+	ErrorMessage       string `json:"errorMessage,omitempty"`
+}
+
+type otlpRejected struct {
+	n    int64
+	msgs []string
+}
+
+func (r *otlpRejected) add(n int, format string, args ...interface{}) {
+	if n == 0 {
+		return
+	}
+	r.n += int64(n)
+	msg := fmt.Sprintf(format, args...)
+	if indexOf(r.msgs, msg) == -1 {
+		r.msgs = append(r.msgs, msg)
+	}
+}
+
+// ServeHTTP implements http.Handler interface
+func (o *OTLPReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	InflateRequest(http.HandlerFunc(o.serveHTTP)).ServeHTTP(w, r)
+}
+
+func (o *OTLPReceiver) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method != http.MethodPost {
+		code := http.StatusMethodNotAllowed
+		http.Error(w, http.StatusText(code), code)
+		return
+	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		code := http.StatusUnsupportedMediaType
+		http.Error(w, http.StatusText(code), code)
+		return
+	}
+	var req otlpMetricsRequest
+	body := http.MaxBytesReader(w, r.Body, maxOTLPBodySize)
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		code := http.StatusBadRequest
+		http.Error(w, http.StatusText(code), code)
+		return
+	}
+	rejected, err := o.export(r, &req)
+	if err != nil {
+		code := http.StatusServiceUnavailable
+		http.Error(w, http.StatusText(code), code)
+		return
+	}
+	res := OTLPResponse{}
+	if rejected.n > 0 {
+		res.PartialSuccess = &OTLPPartialSuccess{
+			RejectedDataPoints: rejected.n,
+			ErrorMessage:       strings.Join(rejected.msgs, "; "),
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&res)
+}
+
+func (o *OTLPReceiver) export(r *http.Request, req *otlpMetricsRequest) (*otlpRejected, error) {
+	ctx := r.Context()
+	now := time.Now().UnixNano()
+	var (
+		rejected otlpRejected
+		groups   requestGroups
+		// updates of each request undone if it fails to store
+		updates [][]otlpUpdate
+		points  []int
+	)
+	add := func(event string, tm time.Time, fields Fields, n int64) int {
+		i := groups.add(event, tm, fields, n)
+		if i == len(points) {
+			updates = append(updates, nil)
+			points = append(points, 0)
+		}
+		points[i]++
+		return i
+	}
+	o.mu.Lock()
+	o.prune(now)
+	exported := o.exported
+	// update changes the state of a series from the state its delta was counted from,
+	// i is the index of its request or -1
+	update := func(i int, key string, prev, next otlpSeries) {
+		if o.last == nil {
+			o.last = make(map[string]otlpSeries)
+		}
+		// The series is seen even if the update is undone
+		prev.seen, next.seen = now, now
+		o.last[key] = next
+		if i != -1 {
+			updates[i] = append(updates[i], otlpUpdate{key: key, prev: prev, next: next})
+		}
+	}
+	for i := range req.ResourceMetrics {
+		rm := &req.ResourceMetrics[i]
+		var resource Fields
+		for _, a := range rm.Resource.Attributes {
+			if indexOf(o.ResourceAttributes, "*") != -1 || indexOf(o.ResourceAttributes, a.Key) != -1 {
+				resource = resource.set(a.Key, a.Value.String())
+			}
+		}
+		for j := range rm.ScopeMetrics {
+			for k := range rm.ScopeMetrics[j].Metrics {
+				m := &rm.ScopeMetrics[j].Metrics[k]
+				sum := m.Sum
+				switch {
+				case m.Gauge != nil:
+					rejected.add(len(m.Gauge.DataPoints), "Unsupported metric type gauge")
+					continue
+				case m.Histogram != nil:
+					rejected.add(len(m.Histogram.DataPoints), "Unsupported metric type histogram")
+					continue
+				case m.ExponentialHistogram != nil:
+					rejected.add(len(m.ExponentialHistogram.DataPoints), "Unsupported metric type exponential histogram")
+					continue
+				case m.Summary != nil:
+					rejected.add(len(m.Summary.DataPoints), "Unsupported metric type summary")
+					continue
+				case sum == nil:
+					continue
+				case !sum.IsMonotonic:
+					rejected.add(len(sum.DataPoints), "Unsupported non-monotonic sum")
+					continue
+				case sum.AggregationTemporality != otlpTemporalityDelta && sum.AggregationTemporality != otlpTemporalityCumulative:
+					rejected.add(len(sum.DataPoints), "Unsupported aggregation temporality %d", sum.AggregationTemporality)
+					continue
+				case !allow(ctx, ScopeWrite, m.Name):
+					rejected.add(len(sum.DataPoints), "Forbidden event %q", m.Name)
+					continue
+				}
+				for p := range sum.DataPoints {
+					dp := &sum.DataPoints[p]
+					var v float64
+					switch {
+					case dp.AsInt != nil:
+						v = float64(*dp.AsInt)
+					case dp.AsDouble != nil:
+						v = float64(*dp.AsDouble)
+					}
+					if dp.AsInt == nil && dp.AsDouble == nil || math.IsNaN(v) || math.IsInf(v, 0) || v < 0 {
+						rejected.add(1, "Invalid data point value")
+						continue
+					}
+					fields := resource.Copy()
+					for _, a := range dp.Attributes {
+						fields = fields.set(a.Key, a.Value.String())
+					}
+					sort.Sort(fields)
+					tm := time.Unix(0, int64(dp.TimeUnixNano)).Truncate(time.Second)
+					if dp.TimeUnixNano == 0 {
+						tm = time.Now().Truncate(time.Second)
+					}
+					if sum.AggregationTemporality == otlpTemporalityDelta {
+						key := seriesKey("delta", m.Name, fields)
+						last := o.last[key]
+						v += last.value
+						n := math.Floor(v)
+						i := -1
+						if n > 0 {
+							i = add(m.Name, tm, fields, int64(n))
+						}
+						update(i, key, last, otlpSeries{value: v - n})
+						continue
+					}
+					key := seriesKey("cumulative", m.Name, fields)
+					start := int64(dp.StartTimeUnixNano)
+					last, seen := o.last[key]
+					switch {
+					case !seen && (exported == 0 || start <= exported):
+						// The series may have started before the previous export
+						update(-1, key, last, otlpSeries{start: start, value: v})
+						continue
+					case !seen, last.start != start, v < last.value:
+						// New series or counter reset
+						last = otlpSeries{start: start}
+					}
+					n := math.Floor(v - last.value)
+					i := -1
+					if n > 0 {
+						i = add(m.Name, tm, fields, int64(n))
+					}
+					update(i, key, last, otlpSeries{start: start, value: last.value + n})
+				}
+			}
+		}
+	}
+	o.mu.Unlock()
+
+	var (
+		errs   StoreErrors
+		stored int
+		failed int
+	)
+	for i := range groups.reqs {
+		req := &groups.reqs[i]
+		req.addCertField(ctx)
+		err := o.Store.Store(req)
+		if err == nil || errors.Is(err, ErrDuplicate) {
+			stored++
+			continue
+		}
+		// Deltas are counted again on the next export
+		o.rollback(updates[i])
+		var missing errMissingEvent
+		if errors.As(err, &missing) {
+			rejected.add(points[i], "%s", err)
+			continue
+		}
+		errs = append(errs, err)
+		failed += points[i]
+	}
+	if len(errs) > 0 && stored == 0 {
+		// Nothing was stored so the export can be retried
+		return &rejected, errs
+	}
+	rejected.add(failed, "%s", errs)
+	o.mu.Lock()
+	if now > o.exported {
+		o.exported = now
+	}
+	o.mu.Unlock()
+	return &rejected, nil
+}
+
+// prune drops series not seen within Retention, at most once every Retention
+//
+// It must be called holding mu.
+func (o *OTLPReceiver) prune(now int64) {
+	retention := o.Retention
+	if retention <= 0 {
+		retention = DefaultOTLPRetention
+	}
+	if now-o.pruned < int64(retention) {
+		return
+	}
+	o.pruned = now
+	for key, s := range o.last {
+		if now-s.seen > int64(retention) {
+			delete(o.last, key)
+		}
+	}
+}
+
+// rollback undoes the updates of a request unless a later export changed them
+func (o *OTLPReceiver) rollback(updates []otlpUpdate) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for i := len(updates) - 1; i >= 0; i-- {
+		u := &updates[i]
+		if o.last[u.key] == u.next {
+			o.last[u.key] = u.prev
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package meter_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	meter "github.com/alxarch/go-meter/v2"
+)
+
+func TestOTLPReceiver(t *testing.T) {
+	db := &testStore{}
+	o := &meter.OTLPReceiver{
+		Store:              db,
+		ResourceAttributes: []string{"service.name"},
+	}
+	post := func(contentType, body string) (int, meter.OTLPResponse) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/v1/metrics", strings.NewReader(body))
+		r.Header.Set("Content-Type", contentType)
+		o.ServeHTTP(w, r)
+		var res meter.OTLPResponse
+		if w.Code == http.StatusOK {
+			AssertNil(t, json.Unmarshal(w.Body.Bytes(), &res))
+		}
+		return w.Code, res
+	}
+	body := func(cumulative string) string {
+		return `{"resourceMetrics":[{
+			"resource":{"attributes":[
+				{"key":"service.name","value":{"stringValue":"api"}},
+				{"key":"host.name","value":{"stringValue":"h1"}}
+			]},
+			"scopeMetrics":[{"metrics":[
+				{"name":"requests","sum":{"aggregationTemporality":1,"isMonotonic":true,"dataPoints":[
+					{"attributes":[{"key":"status","value":{"intValue":"200"}}],"timeUnixNano":"1500000000000000000","asInt":"3"},
+					{"attributes":[{"key":"status","value":{"intValue":500}}],"timeUnixNano":"1500000000000000000","asDouble":1}
+				]}},
+				{"name":"jobs","sum":{"aggregationTemporality":"AGGREGATION_TEMPORALITY_CUMULATIVE","isMonotonic":true,"dataPoints":[
+					{"attributes":[{"key":"queue","value":{"stringValue":"q1"}}],"startTimeUnixNano":"1","timeUnixNano":"1500000000000000000","asDouble":` + cumulative + `}
+				]}},
+				{"name":"temperature","gauge":{"dataPoints":[{"asDouble":21.5},{"asDouble":22}]}},
+				{"name":"queue_size","sum":{"aggregationTemporality":2,"isMonotonic":false,"dataPoints":[{"asInt":"3"}]}}
+			]}]
+		}]}`
+	}
+	code, res := post("application/json", body("10.5"))
+	AssertEqual(t, code, http.StatusOK)
+	Assert(t, res.PartialSuccess != nil, "No partial success")
+	AssertEqual(t, res.PartialSuccess.RejectedDataPoints, int64(3))
+	AssertEqual(t, res.PartialSuccess.ErrorMessage, "Unsupported metric type gauge; Unsupported non-monotonic sum")
+	AssertEqual(t, len(db.data), 1)
+	r := db.data[0]
+	AssertEqual(t, r.Event, "requests")
+	AssertEqual(t, r.Time, time.Unix(1500000000, 0))
+	AssertEqual(t, r.Labels, []string{"service.name", "status"})
+	AssertSnapshot(t, r.Counters, meter.Snapshot{
+		{Values: []string{"api", "200"}, Count: 3},
+		{Values: []string{"api", "500"}, Count: 1},
+	})
+
+	// Cumulative deltas carry fractions
+	code, _ = post("application/json", body("13"))
+	AssertEqual(t, code, http.StatusOK)
+	AssertEqual(t, len(db.data), 3)
+	r = db.data[2]
+	AssertEqual(t, r.Event, "jobs")
+	AssertEqual(t, r.Labels, []string{"queue", "service.name"})
+	AssertSnapshot(t, r.Counters, meter.Snapshot{{Values: []string{"q1", "api"}, Count: 2}})
+	code, _ = post("application/json", body("13.5"))
+	AssertEqual(t, code, http.StatusOK)
+	AssertEqual(t, len(db.data), 5)
+	AssertEqual(t, db.data[4].Counters[0].Count, int64(1))
+	// Reset
+	code, _ = post("application/json", body("4"))
+	AssertEqual(t, code, http.StatusOK)
+	AssertEqual(t, len(db.data), 7)
+	AssertEqual(t, db.data[6].Counters[0].Count, int64(4))
+
+	// Failed stores are retried
+	db.setFail(true)
+	code, _ = post("application/json", body("6"))
+	AssertEqual(t, code, http.StatusServiceUnavailable)
+	db.setFail(false)
+	code, _ = post("application/json", body("6"))
+	AssertEqual(t, code, http.StatusOK)
+	AssertEqual(t, len(db.data), 9)
+	AssertEqual(t, db.data[8].Counters[0].Count, int64(2))
+
+	// Series not seen within the retention start over
+	o.Retention = time.Millisecond
+	time.Sleep(5 * time.Millisecond)
+	code, _ = post("application/json", body("8"))
+	AssertEqual(t, code, http.StatusOK)
+	AssertEqual(t, len(db.data), 10)
+	AssertEqual(t, db.data[9].Event, "requests")
+	o.Retention = time.Hour
+	code, _ = post("application/json", body("9"))
+	AssertEqual(t, code, http.StatusOK)
+	AssertEqual(t, len(db.data), 12)
+	AssertEqual(t, db.data[11].Counters[0].Count, int64(1))
+
+	code, _ = post("application/x-protobuf", "")
+	AssertEqual(t, code, http.StatusUnsupportedMediaType)
+	code, _ = post("application/json", "{")
+	AssertEqual(t, code, http.StatusBadRequest)
+	code, _ = post("application/json", strings.Repeat(" ", 33<<20)+"{}")
+	AssertEqual(t, code, http.StatusBadRequest)
+}
+
+func TestOTLPReceiver_PartialFailure(t *testing.T) {
+	db := &testStore{}
+	var fail int32
+	o := &meter.OTLPReceiver{
+		Store: storeFunc(func(r *meter.StoreRequest) error {
+			if r.Event == "jobs" && atomic.LoadInt32(&fail) == 1 {
+				return errors.New("Store failed")
+			}
+			return db.Store(r)
+		}),
+	}
+	post := func(body string) meter.OTLPResponse {
+		t.Helper()
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/v1/metrics", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		o.ServeHTTP(w, r)
+		AssertEqual(t, w.Code, http.StatusOK)
+		var res meter.OTLPResponse
+		AssertNil(t, json.Unmarshal(w.Body.Bytes(), &res))
+		return res
+	}
+	body := func(jobs string) string {
+		return `{"resourceMetrics":[{
+			"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"api"}}]},
+			"scopeMetrics":[{"metrics":[
+				{"name":"requests","sum":{"aggregationTemporality":1,"isMonotonic":true,"dataPoints":[{"asDouble":1.5}]}},
+				{"name":"jobs","sum":{"aggregationTemporality":2,"isMonotonic":true,"dataPoints":[` + jobs + `]}}
+			]}]
+		}]}`
+	}
+	q1 := func(v string) string {
+		return `{"attributes":[{"key":"queue","value":{"stringValue":"q1"}}],"startTimeUnixNano":"1","asInt":"` + v + `"}`
+	}
+	total := func(event string) (n int64) {
+		for _, r := range db.data {
+			if r.Event == event {
+				for _, c := range r.Counters {
+					n += c.Count
+				}
+			}
+		}
+		return
+	}
+	// Resource attributes are not added by default
+	res := post(body(q1("5")))
+	AssertEqual(t, res.PartialSuccess, (*meter.OTLPPartialSuccess)(nil))
+	AssertEqual(t, len(db.data), 1)
+	AssertEqual(t, len(db.data[0].Labels), 0)
+	// Delta fractions are carried over
+	AssertEqual(t, total("requests"), int64(1))
+	AssertEqual(t, total("jobs"), int64(0))
+
+	// Points of failed requests are rejected and counted on the next export
+	started := strconv.FormatInt(time.Now().UnixNano(), 10)
+	q2 := `{"attributes":[{"key":"queue","value":{"stringValue":"q2"}}],"startTimeUnixNano":"` + started + `","asInt":"3"}`
+	atomic.StoreInt32(&fail, 1)
+	res = post(body(q1("7") + "," + q2))
+	Assert(t, res.PartialSuccess != nil, "No partial success")
+	AssertEqual(t, res.PartialSuccess.RejectedDataPoints, int64(2))
+	AssertEqual(t, res.PartialSuccess.ErrorMessage, "Store failed")
+	AssertEqual(t, total("requests"), int64(3))
+	atomic.StoreInt32(&fail, 0)
+	res = post(body(q1("7") + "," + q2))
+	AssertEqual(t, res.PartialSuccess, (*meter.OTLPPartialSuccess)(nil))
+	AssertEqual(t, total("requests"), int64(4))
+	// Series started after the previous export count their first value
+	AssertEqual(t, total("jobs"), int64(5))
+}
@@ -0,0 +1,387 @@
+package meter
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ContentTypePrometheus is the content type of the Prometheus text format
+const ContentTypePrometheus = "text/plain; version=0.0.4; charset=utf-8"
+
+// Exporter renders Events in Prometheus text format
+//
+// Counts are rendered as cumulative counters. The Exporter keeps the totals
+// of flushed counters of each event so exporting does not interfere with
+// syncing events to a store. Counters flushed before an event is exported
+// for the first time are not included.
+// Counter events are rendered as NAME_total and NAME_sum if they have sums,
+// gauge events as NAME with their last value and events with a BucketLabel
+// as histograms.
+type Exporter struct {
+	// Namespace is prefixed to metric names
+	Namespace string
+
+	events func() []*Event
+	mu     sync.Mutex
+	totals map[*Event]*promTotals
+}
+
+// NewExporter creates an Exporter for events
+func NewExporter(events ...*Event) *Exporter {
+	events = append([]*Event(nil), events...)
+	x := Exporter{
+		events: func() []*Event {
+			return events
+		},
+	}
+	for _, e := range events {
+		x.eventTotals(e)
+	}
+	return &x
+}
+
+// Exporter creates an Exporter for all registered events
+func (r *Registry) Exporter() *Exporter {
+	x := Exporter{
+		events: r.Events,
+	}
+	for _, e := range r.Events() {
+		x.eventTotals(e)
+	}
+	return &x
+}
+
+// ServeHTTP implements http.Handler interface
+func (x *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", ContentTypePrometheus)
+	x.WriteTo(w)
+}
+
+// WriteTo writes all events in Prometheus text format
+func (x *Exporter) WriteTo(w io.Writer) (int64, error) {
+	events := append([]*Event(nil), x.events()...)
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Name < events[j].Name
+	})
+	out := promWriter{w: bufio.NewWriter(w)}
+	var s Snapshot
+	for _, e := range events {
+		s = x.eventTotals(e).snapshot(e, s[:0])
+		sort.Slice(s, func(i, j int) bool {
+			return lessValues(s[i].Values, s[j].Values)
+		})
+		name := promName(x.Namespace, e.Name)
+		switch {
+		case e.Kind == GaugeKind:
+			out.gauge(name, e.Labels, s)
+		case indexOf(e.Labels, BucketLabel) != -1:
+			out.histogram(name, e.Labels, s)
+		default:
+			out.counter(name, e.Labels, s)
+		}
+	}
+	if out.err == nil {
+		out.err = out.w.Flush()
+	}
+	return out.n, out.err
+}
+
+// eventTotals returns the totals of an event starting to keep them if needed
+func (x *Exporter) eventTotals(e *Event) *promTotals {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	t := x.totals[e]
+	if t == nil {
+		if x.totals == nil {
+			x.totals = make(map[*Event]*promTotals)
+		}
+		t = &promTotals{
+			series: make(map[string]*Counter),
+		}
+		x.totals[e] = t
+		e.onFlush(t.flushed)
+	}
+	return t
+}
+
+// promTotals are the cumulative totals of the flushed counters of an event
+type promTotals struct {
+	mu     sync.Mutex
+	series map[string]*Counter
+}
+
+func (t *promTotals) flushed(s Snapshot) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := range s {
+		c := &s[i]
+		key := strings.Join(c.Values, "\x00")
+		total := t.series[key]
+		if total == nil {
+			total = &Counter{Values: c.Values}
+			t.series[key] = total
+		}
+		total.Count += c.Count
+		total.Sum += c.Sum
+		if c.Count != 0 {
+			total.Last = c.Last
+		}
+	}
+}
+
+// snapshot appends the totals of flushed and current counters of an event to s
+//
+// Count and Sum are the totals of flushed and current values and
+// Last is the latest gauge value. Min and Max are not set.
+func (t *promTotals) snapshot(e *Event, s Snapshot) Snapshot {
+	current := make(map[string]struct{})
+	e.view(func(counters []*Counter) {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		for _, c := range counters {
+			key := strings.Join(c.Values, "\x00")
+			current[key] = struct{}{}
+			n := atomic.LoadInt64(&c.Count)
+			total := Counter{
+				Count:  n,
+				Values: c.Values,
+				Sum:    atomicLoadFloat64(&c.Sum),
+				Last:   c.Last,
+			}
+			if flushed := t.series[key]; flushed != nil {
+				total.Count += flushed.Count
+				total.Sum += flushed.Sum
+				if n == 0 {
+					total.Last = flushed.Last
+				}
+			}
+			s = append(s, total)
+		}
+	})
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// Counters dropped by Pack
+	for key, flushed := range t.series {
+		if _, ok := current[key]; !ok {
+			s = append(s, *flushed)
+		}
+	}
+	return s
+}
+
+type promWriter struct {
+	w   *bufio.Writer
+	buf []byte
+	n   int64
+	err error
+}
+
+func (p *promWriter) write(b []byte) {
+	if p.err == nil {
+		var n int
+		n, p.err = p.w.Write(b)
+		p.n += int64(n)
+	}
+}
+
+func (p *promWriter) typ(name, typ string) {
+	p.buf = append(p.buf[:0], "# TYPE "...)
+	p.buf = append(p.buf, name...)
+	p.buf = append(p.buf, ' ')
+	p.buf = append(p.buf, typ...)
+	p.buf = append(p.buf, '\n')
+	p.write(p.buf)
+}
+
+// sample writes a sample, extra is an extra label pair appended to labels
+func (p *promWriter) sample(name string, labels, values []string, extra []string, v float64) {
+	b := append(p.buf[:0], name...)
+	if len(labels) > 0 || len(extra) > 0 {
+		b = append(b, '{')
+		n := 0
+		for i, label := range labels {
+			if i < len(values) {
+				b = appendPromLabel(b, n, label, values[i])
+				n++
+			}
+		}
+		for i := 0; i+1 < len(extra); i += 2 {
+			b = appendPromLabel(b, n, extra[i], extra[i+1])
+			n++
+		}
+		b = append(b, '}')
+	}
+	b = append(b, ' ')
+	b = appendPromFloat(b, v)
+	b = append(b, '\n')
+	p.buf = b
+	p.write(b)
+}
+
+func (p *promWriter) counter(name string, labels []string, s Snapshot) {
+	labels = promLabels(labels)
+	p.typ(name+"_total", "counter")
+	hasSum := false
+	for i := range s {
+		c := &s[i]
+		p.sample(name+"_total", labels, c.Values, nil, float64(c.Count))
+		hasSum = hasSum || c.Sum != 0
+	}
+	if !hasSum {
+		return
+	}
+	p.typ(name+"_sum", "counter")
+	for i := range s {
+		c := &s[i]
+		p.sample(name+"_sum", labels, c.Values, nil, c.Sum)
+	}
+}
+
+func (p *promWriter) gauge(name string, labels []string, s Snapshot) {
+	labels = promLabels(labels)
+	p.typ(name, "gauge")
+	for i := range s {
+		c := &s[i]
+		p.sample(name, labels, c.Values, nil, c.Last)
+	}
+}
+
+// histogram writes counters of an event with a BucketLabel as cumulative buckets
+func (p *promWriter) histogram(name string, labels []string, s Snapshot) {
+	le := indexOf(labels, BucketLabel)
+	type series struct {
+		values  []string
+		buckets bucketCounts
+		sum     float64
+		count   int64
+	}
+	var all []*series
+	index := make(map[string]*series)
+	for i := range s {
+		c := &s[i]
+		values := withoutIndex(c.Values, le)
+		key := strings.Join(values, "\x00")
+		h := index[key]
+		if h == nil {
+			h = &series{values: values}
+			index[key] = h
+			all = append(all, h)
+		}
+		if le < len(c.Values) {
+			if bound, ok := parseBound(c.Values[le]); ok {
+				h.buckets = h.buckets.add(bound, c.Count)
+			}
+		}
+		h.sum += c.Sum
+		h.count += c.Count
+	}
+	labels = promLabels(withoutIndex(labels, le))
+	p.typ(name, "histogram")
+	for _, h := range all {
+		sort.Sort(h.buckets)
+		var n int64
+		for _, b := range h.buckets {
+			if math.IsInf(b.Bound, 1) {
+				continue
+			}
+			n += b.Count
+			p.sample(name+"_bucket", labels, h.values, []string{BucketLabel, formatBound(b.Bound)}, float64(n))
+		}
+		p.sample(name+"_bucket", labels, h.values, []string{BucketLabel, "+Inf"}, float64(h.count))
+		p.sample(name+"_sum", labels, h.values, nil, h.sum)
+		p.sample(name+"_count", labels, h.values, nil, float64(h.count))
+	}
+}
+
+func withoutIndex(ss []string, i int) []string {
+	out := make([]string, 0, len(ss))
+	out = append(out, ss[:i]...)
+	if i < len(ss) {
+		out = append(out, ss[i+1:]...)
+	}
+	return out
+}
+
+func lessValues(a, b []string) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return len(a) < len(b)
+}
+
+// promName converts an event name to a valid metric name
+func promName(namespace, name string) string {
+	if namespace != "" {
+		name = namespace + "_" + name
+	}
+	return sanitizePromName(name, true)
+}
+
+func promLabels(labels []string) []string {
+	out := make([]string, len(labels))
+	for i, label := range labels {
+		out[i] = sanitizePromName(label, false)
+	}
+	return out
+}
+
+// sanitizePromName replaces invalid characters of metric and label names with '_'
+func sanitizePromName(name string, metric bool) string {
+	b := []byte(name)
+	for i, c := range b {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', c == '_':
+		case c == ':' && metric:
+		case '0' <= c && c <= '9' && i > 0:
+		default:
+			b[i] = '_'
+		}
+	}
+	if len(b) == 0 {
+		return "_"
+	}
+	return string(b)
+}
+
+func appendPromLabel(b []byte, n int, label, value string) []byte {
+	if n > 0 {
+		b = append(b, ',')
+	}
+	b = append(b, label...)
+	b = append(b, '=', '"')
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; c {
+		case '\\':
+			b = append(b, '\\', '\\')
+		case '"':
+			b = append(b, '\\', '"')
+		case '\n':
+			b = append(b, '\\', 'n')
+		default:
+			b = append(b, c)
+		}
+	}
+	return append(b, '"')
+}
+
+func appendPromFloat(b []byte, v float64) []byte {
+	switch {
+	case math.IsInf(v, 1):
+		return append(b, "+Inf"...)
+	case math.IsInf(v, -1):
+		return append(b, "-Inf"...)
+	case math.IsNaN(v):
+		return append(b, "NaN"...)
+	default:
+		return strconv.AppendFloat(b, v, 'g', -1, 64)
+	}
+}
@@ -0,0 +1,64 @@
+package meter_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	meter "github.com/alxarch/go-meter/v2"
+)
+
+func TestExporter(t *testing.T) {
+	requests := meter.NewEvent("requests", "method", "path")
+	bytesSent := meter.NewEvent("bytes.sent", "host")
+	temp := meter.NewGauge("temperature", "room")
+	latency := meter.NewHistogram("latency", []float64{0.1, 1}, "route")
+	events := []*meter.Event{requests, bytesSent, temp, latency.Event}
+	x := meter.NewExporter(events...)
+	x.Namespace = "app"
+
+	requests.Add(2, "GET", "/")
+	requests.Add(1, "POST", `/"quoted"`)
+	bytesSent.AddSum(1, 512, "example.org")
+	temp.Set(21.5, "kitchen")
+	latency.Observe(0.05, "/")
+	latency.Observe(0.5, "/")
+	latency.Observe(5, "/")
+
+	// Syncing to a store does not reset exported totals
+	db := &testStore{}
+	AssertNil(t, requests.SyncTask(db)(time.Now()))
+	requests.Pack()
+	requests.Add(1, "GET", "/")
+	db.setFail(true)
+	Assert(t, bytesSent.SyncTask(db)(time.Now()) != nil, "Sync did not fail")
+	AssertNil(t, temp.SyncTask(&testStore{})(time.Now()))
+
+	w := httptest.NewRecorder()
+	x.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	AssertEqual(t, w.Header().Get("Content-Type"), meter.ContentTypePrometheus)
+	want := `# TYPE app_bytes_sent_total counter
+app_bytes_sent_total{host="example.org"} 1
+# TYPE app_bytes_sent_sum counter
+app_bytes_sent_sum{host="example.org"} 512
+# TYPE app_latency histogram
+app_latency_bucket{route="/",le="0.1"} 1
+app_latency_bucket{route="/",le="1"} 2
+app_latency_bucket{route="/",le="+Inf"} 3
+app_latency_sum{route="/"} 5.55
+app_latency_count{route="/"} 3
+# TYPE app_requests_total counter
+app_requests_total{method="GET",path="/"} 3
+app_requests_total{method="POST",path="/\"quoted\""} 1
+# TYPE app_temperature gauge
+app_temperature{room="kitchen"} 21.5
+`
+	got, _ := ioutil.ReadAll(w.Body)
+	if !bytes.Equal(got, []byte(want)) {
+		t.Errorf("Invalid output\n%s\nwant\n%s", got, want)
+	}
+	// Events passed to NewExporter are not sorted in place
+	AssertEqual(t, events[0], requests)
+}
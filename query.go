@@ -16,9 +16,10 @@ import (
 // Query is a query for event results
 type Query struct {
 	TimeRange
-	Match      Fields   `json:"match,omitempty"`
-	Group      []string `json:"group,omitempty"`
-	EmptyValue string   `json:"empty,omitempty"`
+	Match      Fields    `json:"match,omitempty"`
+	Group      []string  `json:"group,omitempty"`
+	EmptyValue string    `json:"empty,omitempty"`
+	Aggregate  Aggregate `json:"aggregate,omitempty"`
 }
 
 // URL adds the query to a URL
@@ -43,6 +44,9 @@ func (q *Query) URL(baseURL string, events ...string) (string, error) {
 	if q.EmptyValue != "" {
 		values.Set("empty", q.EmptyValue)
 	}
+	if q.Aggregate != CountAggregate {
+		values.Set("aggregate", q.Aggregate.String())
+	}
 	for _, event := range events {
 		values.Add("event", event)
 	}
@@ -99,6 +103,7 @@ func (q *Query) SetValues(values url.Values) {
 	sort.Stable(match)
 	q.Match, q.Group = match, group
 	q.EmptyValue = values.Get("empty")
+	q.Aggregate = AggregateFromString(values.Get("aggregate"))
 }
 
 // TimeRange is a range of time with a specific step
@@ -114,10 +119,19 @@ type QueryRunner interface {
 }
 
 // QueryHandler returns an HTTP endpoint for a QueryRunner
+//
+// Results are rendered as InfluxDB line protocol if the format query parameter is "influx".
 func QueryHandler(qr QueryRunner) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		values := r.URL.Query()
 		events := values["event"]
+		for _, event := range events {
+			if !allow(r.Context(), ScopeRead, event) {
+				code := http.StatusForbidden
+				http.Error(w, http.StatusText(code), code)
+				return
+			}
+		}
 		q := Query{}
 		q.SetValues(values)
 		if q.Start.IsZero() {
@@ -130,12 +144,29 @@ func QueryHandler(qr QueryRunner) http.HandlerFunc {
 		if typ == TotalsResult {
 			q.Step = -1
 		}
+		if typ == QuantilesResult && len(q.Group) > 0 && indexOf(q.Group, BucketLabel) == -1 {
+			// Bucket bounds are needed to estimate quantiles
+			q.Group = append(q.Group, BucketLabel)
+		}
 		ctx := r.Context()
 		results, err := qr.RunQuery(ctx, &q, events...)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		if values.Get("format") == "influx" {
+			precision, err := ParsePrecision(values.Get("precision"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if typ == TotalsResult {
+				results = results.Totals()
+			}
+			w.Header().Set("Content-Type", ContentTypeLineProtocol)
+			w.Write(results.AppendLineProtocol(nil, precision))
+			return
+		}
 		var x interface{}
 		switch typ {
 		case TotalsResult:
@@ -144,6 +175,8 @@ func QueryHandler(qr QueryRunner) http.HandlerFunc {
 			x = results.FieldSummaries()
 		case EventSummaryResult:
 			x = results.EventSummaries(q.EmptyValue)
+		case QuantilesResult:
+			x = results.Quantiles()
 		default:
 			x = results
 		}
@@ -157,6 +190,8 @@ func QueryHandler(qr QueryRunner) http.HandlerFunc {
 type HTTPQueryRunner struct {
 	URL    string
 	Client *http.Client
+	// Auth authenticates requests
+	Auth ClientAuth
 }
 
 // RunQuery implements QueryRunner interface
@@ -172,6 +207,9 @@ func (qr *HTTPQueryRunner) RunQuery(ctx context.Context, q *Query, events ...str
 	if ctx != nil {
 		req = req.WithContext(ctx)
 	}
+	if qr.Auth != nil {
+		qr.Auth.AuthenticateRequest(req, nil)
+	}
 	c := qr.Client
 	if c == nil {
 		c = http.DefaultClient
@@ -0,0 +1,243 @@
+package meter
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// QueuePolicy is the policy of a QueueStore when its queue is full
+type QueuePolicy int
+
+// Queue policies
+const (
+	// QueueBlock blocks Store until there is room in the queue
+	QueueBlock QueuePolicy = iota
+	// QueueDropOldest drops the oldest queued request
+	QueueDropOldest
+	// QueueMerge merges the request into a queued request for the same event and second
+	// Requests with an ID are never merged. It blocks like QueueBlock if no such request is queued.
+	QueueMerge
+)
+
+// QueueStats are the stats of a QueueStore
+type QueueStats struct {
+	Queued  int   `json:"queued"`
+	Stored  int64 `json:"stored"`
+	Failed  int64 `json:"failed"`
+	Dropped int64 `json:"dropped"`
+	Merged  int64 `json:"merged"`
+	// Latency is the average time from Store to completion of a request
+	Latency time.Duration `json:"latency"`
+	// MaxLatency is the max time from Store to completion of a request
+	MaxLatency time.Duration `json:"max_latency"`
+	// LastError is the error of the last failed request
+	LastError string `json:"last_error,omitempty"`
+}
+
+// QueueStore is an EventStore storing requests asynchronously from a bounded queue
+//
+// Store only fails if the queue is closed. Failed requests are counted in Stats
+// which also keeps the last error.
+type QueueStore struct {
+	// OnError is called for each failed request, it must be set before the first Store
+	OnError func(req *StoreRequest, err error)
+
+	db      EventStore
+	policy  QueuePolicy
+	size    int
+	mu      sync.Mutex
+	cond    sync.Cond
+	queue   []queuedRequest
+	closed  bool
+	stats   QueueStats
+	latency time.Duration
+	wg      sync.WaitGroup
+}
+
+type queuedRequest struct {
+	req *StoreRequest
+	tm  time.Time
+}
+
+var errQueueClosed = errors.New("Queue closed")
+
+// NewQueueStore creates a QueueStore of size requests stored to db by a number of workers
+func NewQueueStore(db EventStore, size, workers int, policy QueuePolicy) *QueueStore {
+	if size < 1 {
+		size = 1
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	q := QueueStore{
+		db:     db,
+		policy: policy,
+		size:   size,
+		queue:  make([]queuedRequest, 0, size),
+	}
+	q.cond.L = &q.mu
+	q.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+	return &q
+}
+
+// Store implements EventStore interface
+//
+// The request is copied so it can be reused once Store returns.
+func (q *QueueStore) Store(req *StoreRequest) error {
+	r := *req
+	r.Counters = append(Snapshot(nil), req.Counters...)
+	if r.Time.IsZero() {
+		r.Time = time.Now()
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for !q.closed && len(q.queue) >= q.size {
+		switch q.policy {
+		case QueueDropOldest:
+			q.queue[0] = queuedRequest{}
+			q.queue = q.queue[1:]
+			q.stats.Dropped++
+			continue
+		case QueueMerge:
+			if q.merge(&r) {
+				q.stats.Merged++
+				return nil
+			}
+		}
+		q.cond.Wait()
+	}
+	if q.closed {
+		return errQueueClosed
+	}
+	q.queue = append(q.queue, queuedRequest{req: &r, tm: time.Now()})
+	q.cond.Broadcast()
+	return nil
+}
+
+// merge merges a request into a queued request of the same event and second
+//
+// Requests are stored with second resolution so merging requests of
+// different seconds would move counts to another time. Requests with an ID
+// are not merged so that each ID is stored with its own counters.
+func (q *QueueStore) merge(r *StoreRequest) bool {
+	if r.ID != "" {
+		return false
+	}
+	for i := len(q.queue) - 1; i >= 0; i-- {
+		dst := q.queue[i].req
+		if dst.ID == "" && dst.Event == r.Event && dst.Kind == r.Kind && dst.Time.Unix() == r.Time.Unix() && stringsEqual(dst.Labels, r.Labels) {
+			dst.Counters = dst.Counters.merge(r.Counters)
+			return true
+		}
+	}
+	return false
+}
+
+func (q *QueueStore) work() {
+	defer q.wg.Done()
+	for {
+		q.mu.Lock()
+		for len(q.queue) == 0 && !q.closed {
+			q.cond.Wait()
+		}
+		if len(q.queue) == 0 {
+			q.mu.Unlock()
+			return
+		}
+		item := q.queue[0]
+		q.queue[0] = queuedRequest{}
+		q.queue = q.queue[1:]
+		q.cond.Broadcast()
+		q.mu.Unlock()
+
+		err := q.db.Store(item.req)
+		if errors.Is(err, ErrDuplicate) {
+			err = nil
+		}
+		latency := time.Since(item.tm)
+
+		q.mu.Lock()
+		if err != nil {
+			q.stats.Failed++
+			q.stats.LastError = err.Error()
+		} else {
+			q.stats.Stored++
+		}
+		q.latency += latency
+		if latency > q.stats.MaxLatency {
+			q.stats.MaxLatency = latency
+		}
+		q.mu.Unlock()
+		if err != nil && q.OnError != nil {
+			q.OnError(item.req, err)
+		}
+	}
+}
+
+// Stats returns the current stats of the queue
+func (q *QueueStore) Stats() QueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	s := q.stats
+	s.Queued = len(q.queue)
+	if n := s.Stored + s.Failed; n > 0 {
+		s.Latency = q.latency / time.Duration(n)
+	}
+	return s
+}
+
+// Close stops accepting requests and waits for queued requests to be stored
+func (q *QueueStore) Close(ctx context.Context) error {
+	q.mu.Lock()
+	q.closed = true
+	q.cond.Broadcast()
+	q.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// merge merges counters of src into s
+//
+// Values of src are more recent so their Last value wins.
+func (s Snapshot) merge(src Snapshot) Snapshot {
+	index := make(map[uint64][]int, len(s))
+	for i := range s {
+		h := vhash(s[i].Values)
+		index[h] = append(index[h], i)
+	}
+	for i := range src {
+		c := &src[i]
+		h := vhash(c.Values)
+		var dst *Counter
+		for _, j := range index[h] {
+			if s[j].Match(c.Values) {
+				dst = &s[j]
+				break
+			}
+		}
+		if dst == nil {
+			index[h] = append(index[h], len(s))
+			s = append(s, *c)
+			continue
+		}
+		dst.merge(c)
+		if c.Count != 0 {
+			dst.Last = c.Last
+		}
+	}
+	return s
+}
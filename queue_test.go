@@ -0,0 +1,105 @@
+package meter_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	meter "github.com/alxarch/go-meter/v2"
+)
+
+// blockingStore blocks each Store until a value is sent to ready
+type blockingStore struct {
+	testStore
+	ready chan struct{}
+}
+
+func (s *blockingStore) Store(r *meter.StoreRequest) error {
+	<-s.ready
+	return s.testStore.Store(r)
+}
+
+func TestQueueStore(t *testing.T) {
+	now := time.Now()
+	req := func(event string, n int64, values ...string) *meter.StoreRequest {
+		return &meter.StoreRequest{
+			Event:    event,
+			Time:     now,
+			Labels:   []string{"color"},
+			Counters: meter.Snapshot{{Values: values, Count: n}},
+		}
+	}
+	db := &blockingStore{ready: make(chan struct{})}
+	q := meter.NewQueueStore(db, 2, 1, meter.QueueMerge)
+	AssertNil(t, q.Store(req("foo", 1, "blue")))
+	// Wait for the worker to pick up the first request
+	for q.Stats().Queued != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	AssertNil(t, q.Store(req("foo", 1, "blue")))
+	AssertNil(t, q.Store(req("bar", 1, "blue")))
+	AssertNil(t, q.Store(req("foo", 2, "blue")))
+	AssertNil(t, q.Store(req("foo", 1, "red")))
+	stats := q.Stats()
+	AssertEqual(t, stats.Queued, 2)
+	AssertEqual(t, stats.Merged, int64(2))
+	// Requests of another second are not merged
+	later := req("foo", 1, "blue")
+	later.Time = now.Add(time.Minute)
+	stored := make(chan error)
+	go func() {
+		stored <- q.Store(later)
+	}()
+	// Requests with an ID are not merged
+	withID := req("foo", 1, "blue")
+	withID.ID = meter.NewRequestID()
+	go func() {
+		stored <- q.Store(withID)
+	}()
+	close(db.ready)
+	AssertNil(t, <-stored)
+	AssertNil(t, <-stored)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	AssertNil(t, q.Close(ctx))
+	Assert(t, q.Store(req("foo", 1, "blue")) != nil, "Store after close")
+	stats = q.Stats()
+	AssertEqual(t, stats.Queued, 0)
+	AssertEqual(t, stats.Stored, int64(5))
+	AssertEqual(t, stats.Merged, int64(2))
+	Assert(t, stats.MaxLatency >= stats.Latency, "Invalid latency %v", stats)
+	AssertEqual(t, len(db.data), 5)
+	// The blocked requests are queued in any order
+	last := db.data[3:]
+	if last[0].ID == "" {
+		last[0], last[1] = last[1], last[0]
+	}
+	AssertEqual(t, last[0].ID, withID.ID)
+	AssertEqual(t, last[1].Time, later.Time)
+	AssertEqual(t, db.data[1].Event, "foo")
+	AssertSnapshot(t, db.data[1].Counters, meter.Snapshot{
+		{Values: []string{"blue"}, Count: 3},
+		{Values: []string{"red"}, Count: 1},
+	})
+
+	db = &blockingStore{ready: make(chan struct{})}
+	q = meter.NewQueueStore(db, 1, 1, meter.QueueDropOldest)
+	q.Store(req("foo", 1, "blue"))
+	for q.Stats().Queued != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	q.Store(req("bar", 1, "blue"))
+	q.Store(req("baz", 1, "blue"))
+	AssertEqual(t, q.Stats().Dropped, int64(1))
+	close(db.ready)
+	AssertNil(t, q.Close(ctx))
+	AssertEqual(t, len(db.data), 2)
+	AssertEqual(t, db.data[1].Event, "baz")
+
+	q = meter.NewQueueStore(&testStore{fail: true}, 1, 1, meter.QueueBlock)
+	AssertNil(t, q.Store(req("foo", 1, "blue")))
+	AssertNil(t, q.Close(ctx))
+	stats = q.Stats()
+	AssertEqual(t, stats.Failed, int64(1))
+	AssertEqual(t, stats.LastError, "Store failed")
+}
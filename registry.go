@@ -0,0 +1,220 @@
+package meter
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Registry syncs a named set of Events to an EventStore
+type Registry struct {
+	// Store is the EventStore to sync events to
+	Store EventStore
+	// Interval is the sync interval, defaults to DefaultSyncInterval
+	Interval time.Duration
+	// Jitter is the max random delay added after each step boundary
+	Jitter time.Duration
+	// OnError is called for each failed sync of an event
+	OnError func(event string, err error)
+	// Concurrent syncs events concurrently so that a batching store can coalesce them
+	//
+	// Store must then be safe for concurrent use.
+	Concurrent bool
+
+	mu     sync.Mutex
+	events map[string]*Event
+	tasks  map[*Event]func(time.Time) error
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// DefaultSyncInterval is the default interval of a Registry
+const DefaultSyncInterval = time.Minute
+
+// NewRegistry creates a new Registry syncing to db on every interval
+func NewRegistry(db EventStore, interval time.Duration) *Registry {
+	return &Registry{
+		Store:    db,
+		Interval: interval,
+	}
+}
+
+// Register adds events to the registry
+func (r *Registry) Register(events ...*Event) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, e := range events {
+		if _, duplicate := r.events[e.Name]; duplicate {
+			return fmt.Errorf("Duplicate event %q", e.Name)
+		}
+	}
+	if r.events == nil {
+		r.events = make(map[string]*Event, len(events))
+	}
+	for _, e := range events {
+		r.events[e.Name] = e
+	}
+	return nil
+}
+
+// Unregister removes an event from the registry
+func (r *Registry) Unregister(name string) *Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e := r.events[name]
+	delete(r.events, name)
+	delete(r.tasks, e)
+	return e
+}
+
+// task returns the sync task of an event
+//
+// Tasks are kept so that unchanged requests that failed to store are resent with the same ID.
+func (r *Registry) task(e *Event) func(time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	task, ok := r.tasks[e]
+	if !ok {
+		if r.tasks == nil {
+			r.tasks = make(map[*Event]func(time.Time) error)
+		}
+		task = e.SyncTask(r.Store)
+		r.tasks[e] = task
+	}
+	return task
+}
+
+// Get returns a registered event by name
+func (r *Registry) Get(name string) *Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.events[name]
+}
+
+// Events returns all registered events sorted by name
+func (r *Registry) Events() []*Event {
+	r.mu.Lock()
+	events := make([]*Event, 0, len(r.events))
+	for _, e := range r.events {
+		events = append(events, e)
+	}
+	r.mu.Unlock()
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Name < events[j].Name
+	})
+	return events
+}
+
+// Sync syncs all registered events to the store
+//
+// Events are synced one after the other unless Concurrent is set.
+// Counters of events that fail to sync with a retryable error are sent on the next sync.
+// It returns the first error encountered.
+func (r *Registry) Sync(tm time.Time) (err error) {
+	r.sync(tm, func(_ string, e error) {
+		if err == nil {
+			err = e
+		}
+	})
+	return
+}
+
+func (r *Registry) sync(tm time.Time, onError func(event string, err error)) {
+	if !r.Concurrent {
+		for _, e := range r.Events() {
+			if err := r.task(e)(tm); err != nil && onError != nil {
+				onError(e.Name, err)
+			}
+		}
+		return
+	}
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+	)
+	for _, e := range r.Events() {
+		wg.Add(1)
+		go func(e *Event) {
+			defer wg.Done()
+			if err := r.task(e)(tm); err != nil && onError != nil {
+				mu.Lock()
+				onError(e.Name, err)
+				mu.Unlock()
+			}
+		}(e)
+	}
+	wg.Wait()
+}
+
+func (r *Registry) interval() time.Duration {
+	if r.Interval > 0 {
+		return r.Interval
+	}
+	return DefaultSyncInterval
+}
+
+// next returns the next step boundary and the delay until the sync
+func (r *Registry) next(now time.Time) (time.Time, time.Duration) {
+	interval := r.interval()
+	tm := now.Truncate(interval).Add(interval)
+	delay := tm.Sub(now)
+	if r.Jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(r.Jitter)))
+	}
+	return tm, delay
+}
+
+// Start starts syncing events in the background
+func (r *Registry) Start() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.done != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	r.cancel, r.done = cancel, done
+	go func() {
+		defer close(done)
+		for {
+			tm, delay := r.next(time.Now())
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+				r.sync(tm, r.OnError)
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops background syncing and does a final sync of all events
+func (r *Registry) Stop(ctx context.Context) error {
+	r.mu.Lock()
+	cancel, done := r.cancel, r.done
+	r.cancel, r.done = nil, nil
+	r.mu.Unlock()
+	if cancel != nil {
+		cancel()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- r.Sync(time.Now())
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,69 @@
+package meter_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	meter "github.com/alxarch/go-meter/v2"
+)
+
+type testStore struct {
+	mu   sync.Mutex
+	fail bool
+	data []meter.StoreRequest
+}
+
+func (s *testStore) Store(r *meter.StoreRequest) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail {
+		return errors.New("Store failed")
+	}
+	req := *r
+	req.Counters = append(meter.Snapshot(nil), r.Counters...)
+	s.data = append(s.data, req)
+	return nil
+}
+
+func (s *testStore) setFail(fail bool) {
+	s.mu.Lock()
+	s.fail = fail
+	s.mu.Unlock()
+}
+
+func TestRegistry(t *testing.T) {
+	db := &testStore{fail: true}
+	r := meter.NewRegistry(db, time.Hour)
+	foo := meter.NewEvent("foo", "color")
+	bar := meter.NewEvent("bar", "color")
+	AssertNil(t, r.Register(foo, bar))
+	Assert(t, r.Register(meter.NewEvent("foo")) != nil, "Duplicate event registered")
+	AssertEqual(t, r.Events(), []*meter.Event{bar, foo})
+
+	foo.Add(1, "blue")
+	bar.Add(2, "red")
+	r.Start()
+	Assert(t, r.Sync(time.Now()) != nil, "Sync did not fail")
+	AssertEqual(t, foo.Len(), 1)
+
+	foo.Add(1, "blue")
+	db.setFail(false)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	AssertNil(t, r.Stop(ctx))
+	// Failed counters are merged back
+	AssertEqual(t, len(db.data), 2)
+	for _, req := range db.data {
+		switch req.Event {
+		case "foo":
+			AssertEqual(t, req.Counters, meter.Snapshot{{Values: []string{"blue"}, Count: 2}})
+		case "bar":
+			AssertEqual(t, req.Counters, meter.Snapshot{{Values: []string{"red"}, Count: 2}})
+		default:
+			t.Errorf("Invalid event %q", req.Event)
+		}
+	}
+}
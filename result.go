@@ -9,10 +9,55 @@ import (
 
 // Result is a query result
 type Result struct {
-	Event  string      `json:"event"`
-	Fields Fields      `json:"fields,omitempty"`
-	Total  int64       `json:"total"`
-	Data   []DataPoint `json:"data,omitempty"`
+	Event  string `json:"event"`
+	Fields Fields `json:"fields,omitempty"`
+	Total  int64  `json:"total"`
+	// Aggregate is the value of the query aggregate for the whole range, equal to Total for counts
+	// It is only encoded if it differs from Total so count results are unchanged.
+	Aggregate float64     `json:"aggregate"`
+	Data      []DataPoint `json:"data,omitempty"`
+}
+
+// resultJSON is the JSON encoding of a Result
+type resultJSON struct {
+	Event     string      `json:"event"`
+	Fields    Fields      `json:"fields,omitempty"`
+	Total     int64       `json:"total"`
+	Aggregate *float64    `json:"aggregate,omitempty"`
+	Data      []DataPoint `json:"data,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler interface
+func (r Result) MarshalJSON() ([]byte, error) {
+	tmp := resultJSON{
+		Event:  r.Event,
+		Fields: r.Fields,
+		Total:  r.Total,
+		Data:   r.Data,
+	}
+	if r.Aggregate != float64(r.Total) {
+		tmp.Aggregate = &r.Aggregate
+	}
+	return json.Marshal(tmp)
+}
+
+// UnmarshalJSON implements json.Unmarshaler interface
+func (r *Result) UnmarshalJSON(data []byte) error {
+	var tmp resultJSON
+	if err := json.Unmarshal(data, &tmp); err != nil {
+		return err
+	}
+	*r = Result{
+		Event:     tmp.Event,
+		Fields:    tmp.Fields,
+		Total:     tmp.Total,
+		Aggregate: float64(tmp.Total),
+		Data:      tmp.Data,
+	}
+	if tmp.Aggregate != nil {
+		r.Aggregate = *tmp.Aggregate
+	}
+	return nil
 }
 
 // ResultType is a type of result
@@ -24,6 +69,7 @@ const (
 	TotalsResult
 	EventSummaryResult
 	FieldSummaryResult
+	QuantilesResult
 )
 
 // ResultTypeFromString converts a string to ResultType
@@ -35,6 +81,8 @@ func ResultTypeFromString(s string) ResultType {
 		return EventSummaryResult
 	case "fields":
 		return FieldSummaryResult
+	case "quantiles":
+		return QuantilesResult
 	default:
 		return ArrayResult
 	}
@@ -50,14 +98,16 @@ func (r *Result) Reset() {
 // Add adds n times at ts time to a result
 func (r *Result) Add(ts, n int64) {
 	r.Total += n
+	r.Aggregate += float64(n)
 	for i := len(r.Data) - 1; 0 <= i && i < len(r.Data); i-- {
 		d := &r.Data[i]
 		if d.Timestamp == ts {
 			d.Value += n
+			d.Aggregate += float64(n)
 			return
 		}
 	}
-	r.Data = append(r.Data, DataPoint{Timestamp: ts, Value: n})
+	r.Data = append(r.Data, DataPoint{Timestamp: ts, Value: n, Aggregate: float64(n)})
 	return
 }
 
@@ -74,16 +124,21 @@ func (results Results) Add(event string, fields Fields, n, ts int64) Results {
 		}
 	}
 	return append(results, Result{
-		Event:  event,
-		Fields: fields,
-		Total:  n,
-		Data:   []DataPoint{{ts, n}},
+		Event:     event,
+		Fields:    fields,
+		Total:     n,
+		Aggregate: float64(n),
+		Data:      []DataPoint{{ts, n, float64(n)}},
 	})
 }
 
 // DataPoint is a time/count pair
+//
+// It is encoded as a [timestamp, count] JSON array with the aggregate appended if it differs from the count.
 type DataPoint struct {
 	Timestamp, Value int64
+	// Aggregate is the value of the query aggregate, equal to Value for counts
+	Aggregate float64
 }
 
 // DataPoints is a collection of DataPoints
@@ -128,20 +183,39 @@ func (s DataPoints) Less(i, j int) bool {
 // MarshalJSON implements json.Marshaler interface
 func (p DataPoint) MarshalJSON() (data []byte, err error) {
 	data = make([]byte, 0, 64)
+	data = p.appendTo(data)
+	return data, nil
+}
+
+func (p *DataPoint) appendTo(data []byte) []byte {
 	data = append(data, '[')
 	data = strconv.AppendInt(data, p.Timestamp, 10)
 	data = append(data, ',')
 	data = strconv.AppendInt(data, p.Value, 10)
-	data = append(data, ']')
-	return data, nil
+	if p.Aggregate != float64(p.Value) {
+		data = append(data, ',')
+		data = strconv.AppendFloat(data, p.Aggregate, 'f', -1, 64)
+	}
+	return append(data, ']')
 }
 
 // UnmarshalJSON implements json.Unmarshaler interface
 func (p *DataPoint) UnmarshalJSON(data []byte) (err error) {
-	value := [2]int64{}
-	if err = json.Unmarshal(data, &value); err == nil {
-		p.Timestamp, p.Value = value[0], value[1]
+	value := [3]json.Number{}
+	if err = json.Unmarshal(data, &value); err != nil {
+		return
+	}
+	if p.Timestamp, err = value[0].Int64(); err != nil {
+		return
 	}
+	if p.Value, err = value[1].Int64(); err != nil {
+		return
+	}
+	if value[2] == "" {
+		p.Aggregate = float64(p.Value)
+		return
+	}
+	p.Aggregate, err = value[2].Float64()
 	return
 }
 
@@ -158,11 +232,7 @@ func (s DataPoints) MarshalJSON() (data []byte, err error) {
 			data = append(data, ',')
 
 		}
-		data = append(data, '[')
-		data = strconv.AppendInt(data, p.Timestamp, 10)
-		data = append(data, ',')
-		data = strconv.AppendInt(data, p.Value, 10)
-		data = append(data, ']')
+		data = p.appendTo(data)
 	}
 	data = append(data, ']')
 	return data, nil
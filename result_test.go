@@ -1,7 +1,39 @@
 package meter_test
 
-import "testing"
+import (
+	"encoding/json"
+	"testing"
+
+	meter "github.com/alxarch/go-meter/v2"
+)
 
 func TestResult(t *testing.T) {
 
 }
+
+func TestDataPoint_JSON(t *testing.T) {
+	points := meter.DataPoints{
+		{Timestamp: 60, Value: 3, Aggregate: 3},
+		{Timestamp: 120, Value: 2, Aggregate: 1.5},
+	}
+	data, err := json.Marshal(points)
+	AssertNil(t, err)
+	AssertEqual(t, string(data), `[[60,3],[120,2,1.5]]`)
+	var out meter.DataPoints
+	AssertNil(t, json.Unmarshal(data, &out))
+	AssertEqual(t, out, points)
+}
+
+func TestResult_JSON(t *testing.T) {
+	results := meter.Results{
+		{Event: "foo", Total: 3, Aggregate: 3, Data: []meter.DataPoint{{Timestamp: 60, Value: 3, Aggregate: 3}}},
+		{Event: "bar", Total: 4, Aggregate: 2, Data: []meter.DataPoint{{Timestamp: 60, Value: 4, Aggregate: 2}}},
+		{Event: "baz", Total: 1, Aggregate: 0},
+	}
+	data, err := json.Marshal(results)
+	AssertNil(t, err)
+	AssertEqual(t, string(data), `[{"event":"foo","total":3,"data":[[60,3]]},{"event":"bar","total":4,"aggregate":2,"data":[[60,4,2]]},{"event":"baz","total":1,"aggregate":0}]`)
+	var out meter.Results
+	AssertNil(t, json.Unmarshal(data, &out))
+	AssertEqual(t, out, results)
+}
@@ -22,6 +22,11 @@ type ScanItem struct {
 	Time   int64
 	Count  int64
 	Fields Fields
+	// Aggregates of gauge values
+	Sum  float64
+	Min  float64
+	Max  float64
+	Last float64
 }
 
 // Scanners provides a Scanner for an event
@@ -53,17 +58,17 @@ func (s scanners) RunQuery(ctx context.Context, q *Query, events ...string) (Res
 				return
 			}
 			iter := s.Scan(ctx, q)
-			var results Results
+			var series aggregateResults
 			for iter.Next() {
 				item := iter.Item()
 				tm := q.TruncateTimestamp(item.Time)
-				results = results.Add(event, item.Fields, item.Count, tm)
+				series = series.add(event, &item, tm)
 			}
 			if err := iter.Close(); err != nil {
 				errc <- err
 				return
 			}
-			ch <- results
+			ch <- series.Results(q.Aggregate)
 		}()
 	}
 
@@ -0,0 +1,350 @@
+package meter
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ScrapeTarget is a Prometheus text endpoint scraped into events
+type ScrapeTarget struct {
+	URL     string         `json:"url"`
+	Metrics []ScrapeMetric `json:"metrics"`
+}
+
+// ScrapeMetric maps a Prometheus counter to an event
+type ScrapeMetric struct {
+	// Metric is the sample name of the counter
+	Metric string `json:"metric"`
+	// Event is the name of the event to store deltas to
+	Event string `json:"event"`
+	// Labels are the labels of the event
+	Labels []string `json:"labels"`
+	// LabelMap maps event labels to Prometheus labels, unmapped labels use the same name
+	LabelMap map[string]string `json:"label_map,omitempty"`
+}
+
+func (m *ScrapeMetric) values(labels Fields) []string {
+	values := make([]string, len(m.Labels))
+	for i, label := range m.Labels {
+		if name, ok := m.LabelMap[label]; ok {
+			label = name
+		}
+		values[i], _ = labels.Get(label)
+	}
+	return values
+}
+
+// Scraper periodically scrapes Prometheus text endpoints storing counter deltas as events
+//
+// The first scrape of a series only records its value. Counter resets are
+// detected when a value decreases and the new value is used as delta.
+// Fractional deltas are carried over to the next scrape.
+// Targets are scraped concurrently and series missing from a scrape are forgotten.
+type Scraper struct {
+	// Store is the EventStore deltas are stored to
+	Store EventStore
+	// Targets are the scraped endpoints
+	Targets []ScrapeTarget
+	// Client is the HTTP client used to scrape, defaults to http.DefaultClient
+	Client *http.Client
+	// Interval is the scrape interval, defaults to DefaultSyncInterval
+	Interval time.Duration
+	// OnError is called for each failed scrape of a target
+	OnError func(target string, err error)
+
+	mu      sync.Mutex
+	targets map[scrapeTargetKey]*scrapeState
+}
+
+// scrapeTargetKey identifies a target so that targets with the same URL have their own state
+type scrapeTargetKey struct {
+	index int
+	url   string
+}
+
+// scrapeState is the last values of the series of a target
+type scrapeState struct {
+	mu   sync.Mutex
+	last map[string]float64
+}
+
+// Run scrapes all targets on every interval until ctx is done
+func (s *Scraper) Run(ctx context.Context) {
+	interval := s.Interval
+	if interval <= 0 {
+		interval = DefaultSyncInterval
+	}
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case tm := <-tick.C:
+			s.scrape(ctx, tm, s.OnError)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Scrape scrapes all targets once returning the first error
+func (s *Scraper) Scrape(ctx context.Context, tm time.Time) (err error) {
+	s.scrape(ctx, tm, func(_ string, e error) {
+		if err == nil {
+			err = e
+		}
+	})
+	return
+}
+
+func (s *Scraper) scrape(ctx context.Context, tm time.Time, onError func(target string, err error)) {
+	s.mu.Lock()
+	targets := append([]ScrapeTarget(nil), s.Targets...)
+	// States of removed targets are dropped
+	states := make(map[scrapeTargetKey]*scrapeState, len(targets))
+	for i := range targets {
+		key := scrapeTargetKey{index: i, url: targets[i].URL}
+		st := s.targets[key]
+		if st == nil {
+			st = &scrapeState{}
+		}
+		states[key] = st
+	}
+	s.targets = states
+	s.mu.Unlock()
+
+	var (
+		wg sync.WaitGroup
+		mu sync.Mutex
+	)
+	for i := range targets {
+		wg.Add(1)
+		go func(t *ScrapeTarget, st *scrapeState) {
+			defer wg.Done()
+			if err := s.scrapeTarget(ctx, t, st, tm); err != nil && onError != nil {
+				mu.Lock()
+				onError(t.URL, err)
+				mu.Unlock()
+			}
+		}(&targets[i], states[scrapeTargetKey{index: i, url: targets[i].URL}])
+	}
+	wg.Wait()
+}
+
+func (s *Scraper) scrapeTarget(ctx context.Context, t *ScrapeTarget, st *scrapeState, tm time.Time) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	req, err := http.NewRequest(http.MethodGet, t.URL, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", ContentTypePrometheus)
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Invalid HTTP status: [%d] %s", res.StatusCode, res.Status)
+	}
+	type eventDeltas struct {
+		metric   *ScrapeMetric
+		counters UnsafeCounters
+		last     map[string]float64
+	}
+	events := make(map[string]*eventDeltas)
+	var (
+		order []string
+		seen  = make(map[string]bool)
+	)
+	err = parsePromText(res.Body, func(name string, labels Fields, v float64) {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			// Non-finite samples are not counts
+			return
+		}
+		for i := range t.Metrics {
+			m := &t.Metrics[i]
+			if m.Metric != name {
+				continue
+			}
+			// Events mapped to the same metric are stored separately so they need their own series
+			key := seriesKey(m.Event, name, labels)
+			seen[key] = true
+			last, ok := st.last[key]
+			if v < last {
+				// Counter reset
+				last = 0
+			}
+			d := events[m.Event]
+			if d == nil {
+				d = &eventDeltas{
+					metric: m,
+					last:   make(map[string]float64),
+				}
+				events[m.Event] = d
+				order = append(order, m.Event)
+			}
+			if !ok {
+				d.last[key] = v
+				continue
+			}
+			n := math.Floor(v - last)
+			d.last[key] = last + n
+			if n > 0 {
+				d.counters.Add(int64(n), m.values(labels)...)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	// Series missing from the scrape are dropped
+	last := make(map[string]float64, len(seen))
+	for key := range seen {
+		if v, ok := st.last[key]; ok {
+			last[key] = v
+		}
+	}
+	var errs StoreErrors
+	for _, event := range order {
+		d := events[event]
+		if counters := d.counters.Flush(nil); len(counters) > 0 {
+			err := s.Store.Store(&StoreRequest{
+				ID:       NewRequestID(),
+				Event:    event,
+				Time:     tm,
+				Labels:   d.metric.Labels,
+				Counters: counters,
+			})
+			if err != nil && !errors.Is(err, ErrDuplicate) {
+				// Deltas are retried on the next scrape
+				errs = append(errs, err)
+				continue
+			}
+		}
+		for key, v := range d.last {
+			last[key] = v
+		}
+	}
+	st.last = last
+	return errs.err()
+}
+
+func seriesKey(scope, name string, labels Fields) string {
+	labels = append(Fields(nil), labels...)
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].Label < labels[j].Label
+	})
+	var b strings.Builder
+	b.WriteString(scope)
+	b.WriteByte(0)
+	b.WriteString(name)
+	for _, f := range labels {
+		b.WriteByte(0)
+		b.WriteString(f.Label)
+		b.WriteByte('=')
+		b.WriteString(f.Value)
+	}
+	return b.String()
+}
+
+var errInvalidSample = errors.New("Invalid sample")
+
+// parsePromText parses samples in Prometheus text format
+func parsePromText(r io.Reader, sample func(name string, labels Fields, v float64)) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		name, labels, v, err := parsePromSample(line)
+		if err != nil {
+			return err
+		}
+		sample(name, labels, v)
+	}
+	return scanner.Err()
+}
+
+// parsePromSample parses a sample line, timestamps are ignored
+func parsePromSample(line string) (name string, labels Fields, v float64, err error) {
+	i := strings.IndexAny(line, "{ \t")
+	if i <= 0 {
+		return "", nil, 0, errInvalidSample
+	}
+	name, line = line[:i], line[i:]
+	if line[0] == '{' {
+		line = line[1:]
+		for {
+			line = strings.TrimLeft(line, " \t,")
+			if line == "" {
+				return "", nil, 0, errInvalidSample
+			}
+			if line[0] == '}' {
+				line = line[1:]
+				break
+			}
+			eq := strings.IndexByte(line, '=')
+			if eq <= 0 || eq+1 >= len(line) || line[eq+1] != '"' {
+				return "", nil, 0, errInvalidSample
+			}
+			label := strings.TrimSpace(line[:eq])
+			var value string
+			value, line, err = unquotePromValue(line[eq+2:])
+			if err != nil {
+				return "", nil, 0, err
+			}
+			labels = append(labels, Field{Label: label, Value: value})
+		}
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", nil, 0, errInvalidSample
+	}
+	v, err = strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return "", nil, 0, errInvalidSample
+	}
+	return name, labels, v, nil
+}
+
+// unquotePromValue unquotes a label value up to the closing quote
+func unquotePromValue(s string) (string, string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"':
+			return b.String(), s[i+1:], nil
+		case '\\':
+			i++
+			if i == len(s) {
+				return "", "", errInvalidSample
+			}
+			switch s[i] {
+			case 'n':
+				b.WriteByte('\n')
+			default:
+				b.WriteByte(s[i])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", "", errInvalidSample
+}
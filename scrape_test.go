@@ -0,0 +1,146 @@
+package meter_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	meter "github.com/alxarch/go-meter/v2"
+)
+
+func TestScraper(t *testing.T) {
+	var step int64
+	pages := []string{
+		`# HELP http_requests_total Requests
+# TYPE http_requests_total counter
+http_requests_total{code="200",handler="/api"} 10
+http_requests_total{code="500",handler="/api"} 1 1562222400000
+cpu_seconds_total 1.5
+`,
+		`http_requests_total{handler="/api",code="200"} 15
+http_requests_total{code="500",handler="/api"} 1
+cpu_seconds_total 3.2
+`,
+		// Process restarted
+		`http_requests_total{code="200",handler="/api"} 4
+http_requests_total{code="500",handler="/api", path="a \"b\" \\c"} 2
+cpu_seconds_total 4.1
+`,
+		// Series that went missing start over
+		`http_requests_total{code="200",handler="/api"} 4
+http_requests_total{code="500",handler="/api"} 3
+cpu_seconds_total 4.1
+`,
+		`broken{ 1`,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, pages[atomic.LoadInt64(&step)])
+	}))
+	defer srv.Close()
+	db := &testStore{}
+	s := meter.Scraper{
+		Store: db,
+		Targets: []meter.ScrapeTarget{{
+			URL: srv.URL,
+			Metrics: []meter.ScrapeMetric{
+				{
+					Metric:   "http_requests_total",
+					Event:    "requests",
+					Labels:   []string{"status", "route"},
+					LabelMap: map[string]string{"status": "code", "route": "handler"},
+				},
+				{
+					Metric: "cpu_seconds_total",
+					Event:  "cpu",
+				},
+			},
+		}},
+	}
+	ctx := context.Background()
+	tm := time.Now()
+	AssertNil(t, s.Scrape(ctx, tm))
+	AssertEqual(t, len(db.data), 0)
+
+	atomic.StoreInt64(&step, 1)
+	AssertNil(t, s.Scrape(ctx, tm))
+	AssertEqual(t, len(db.data), 2)
+	AssertEqual(t, db.data[0].Event, "requests")
+	AssertEqual(t, db.data[0].Labels, []string{"status", "route"})
+	AssertSnapshot(t, db.data[0].Counters, meter.Snapshot{{Values: []string{"200", "/api"}, Count: 5}})
+	AssertEqual(t, db.data[1].Event, "cpu")
+	AssertSnapshot(t, db.data[1].Counters, meter.Snapshot{{Values: []string{}, Count: 1}})
+
+	// Failed stores are retried on the next scrape
+	atomic.StoreInt64(&step, 2)
+	db.setFail(true)
+	Assert(t, s.Scrape(ctx, tm) != nil, "Scrape did not fail")
+	db.setFail(false)
+	AssertNil(t, s.Scrape(ctx, tm))
+	AssertEqual(t, len(db.data), 4)
+	AssertSnapshot(t, db.data[2].Counters, meter.Snapshot{{Values: []string{"200", "/api"}, Count: 4}})
+	// Fractions are carried over, 2 of 2.6 seconds are counted
+	AssertSnapshot(t, db.data[3].Counters, meter.Snapshot{{Values: []string{}, Count: 1}})
+
+	atomic.StoreInt64(&step, 3)
+	AssertNil(t, s.Scrape(ctx, tm))
+	AssertEqual(t, len(db.data), 4)
+
+	atomic.StoreInt64(&step, 4)
+	Assert(t, s.Scrape(ctx, tm) != nil, "Invalid page scraped")
+}
+
+func TestScraper_SharedSeries(t *testing.T) {
+	var step int64
+	pages := []string{
+		"x_total 1\ny_total NaN\n",
+		"x_total 3\ny_total NaN\n",
+		"x_total 6\ny_total +Inf\n",
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, pages[atomic.LoadInt64(&step)])
+	}))
+	defer srv.Close()
+	db := &testStore{}
+	var failB int32
+	s := meter.Scraper{
+		Store: storeFunc(func(r *meter.StoreRequest) error {
+			if r.Event == "b" && atomic.LoadInt32(&failB) == 1 {
+				return errors.New("Store failed")
+			}
+			return db.Store(r)
+		}),
+		// Targets with the same URL and events mapped to the same metric have their own series
+		Targets: []meter.ScrapeTarget{
+			{URL: srv.URL, Metrics: []meter.ScrapeMetric{
+				{Metric: "x_total", Event: "a"},
+				{Metric: "x_total", Event: "b"},
+				{Metric: "y_total", Event: "y"},
+			}},
+			{URL: srv.URL, Metrics: []meter.ScrapeMetric{
+				{Metric: "x_total", Event: "c"},
+			}},
+		},
+	}
+	ctx := context.Background()
+	tm := time.Now()
+	AssertNil(t, s.Scrape(ctx, tm))
+	atomic.StoreInt64(&step, 1)
+	atomic.StoreInt32(&failB, 1)
+	Assert(t, s.Scrape(ctx, tm) != nil, "Scrape did not fail")
+	atomic.StoreInt64(&step, 2)
+	atomic.StoreInt32(&failB, 0)
+	AssertNil(t, s.Scrape(ctx, tm))
+	totals := make(map[string]int64)
+	for _, r := range db.data {
+		for _, c := range r.Counters {
+			totals[r.Event] += c.Count
+		}
+	}
+	// Non-finite samples are skipped
+	AssertEqual(t, totals, map[string]int64{"a": 5, "b": 5, "c": 5})
+}
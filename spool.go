@@ -0,0 +1,372 @@
+package meter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SpoolStore is an EventStore that spools requests to disk while the upstream store fails
+//
+// Each spooled request is written to its own file in Dir so a crash can at most
+// lose the request being written. Spooled requests are replayed in order before
+// new requests once the upstream store recovers. A request stored upstream right
+// before a crash may be replayed twice unless it has an ID.
+//
+// Only requests failing with retryable errors, such as network errors and 5xx
+// responses, are spooled. Spooled requests the upstream store rejects are moved
+// to the rejected subdirectory of Dir so they do not block the requests after them.
+//
+// Upstream stores and replays run without holding the spool lock and replays
+// triggered by Store run in a background goroutine. Run replays periodically
+// so an idle spool is drained.
+type SpoolStore struct {
+	// Upstream is the EventStore requests are forwarded to
+	Upstream EventStore
+	// Dir is the spool directory
+	Dir string
+	// MaxSize is the max total size in bytes of spooled requests, oldest requests are dropped first
+	MaxSize int64
+	// MaxAge is the max age of spooled requests, older requests are dropped
+	MaxAge time.Duration
+	// Interval is the replay interval of Run, defaults to DefaultSyncInterval
+	Interval time.Duration
+
+	mu       sync.Mutex
+	files    []spoolFile
+	size     int64
+	seq      uint64
+	dropped  int64
+	rejected int64
+	// replaying is closed when the background replay is done
+	replaying chan struct{}
+	// rmu serializes replays
+	rmu sync.Mutex
+}
+
+type spoolFile struct {
+	name string
+	size int64
+	seq  uint64
+}
+
+const (
+	spoolFileExt     = ".req"
+	spoolRejectedDir = "rejected"
+)
+
+// NewSpoolStore creates a SpoolStore for upstream loading any requests spooled in dir
+func NewSpoolStore(dir string, upstream EventStore) (*SpoolStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	s := SpoolStore{
+		Upstream: upstream,
+		Dir:      dir,
+	}
+	for _, info := range entries {
+		name := info.Name()
+		if info.IsDir() {
+			continue
+		}
+		if strings.HasSuffix(name, ".tmp") {
+			// Partial write before a crash
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		if !strings.HasSuffix(name, spoolFileExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, spoolFileExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		s.files = append(s.files, spoolFile{name: name, size: info.Size(), seq: seq})
+		s.size += info.Size()
+		if seq >= s.seq {
+			s.seq = seq + 1
+		}
+	}
+	sort.Slice(s.files, func(i, j int) bool {
+		return s.files[i].seq < s.files[j].seq
+	})
+	return &s, nil
+}
+
+// Store implements EventStore interface
+//
+// Requests are forwarded upstream if nothing is spooled, otherwise they are
+// spooled after any pending requests and a background replay is started.
+// An error is returned if the upstream store rejects the request or if it
+// could not be spooled.
+func (s *SpoolStore) Store(req *StoreRequest) error {
+	s.mu.Lock()
+	spooled := len(s.files) > 0
+	s.mu.Unlock()
+	if !spooled {
+		err := s.Upstream.Store(req)
+		if err == nil || errors.Is(err, ErrDuplicate) {
+			return nil
+		}
+		if !retryable(err) {
+			return err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.spool(req); err != nil {
+		return err
+	}
+	s.replayBackground()
+	return nil
+}
+
+// replayBackground starts a background replay unless one is running
+//
+// It must be called holding mu.
+func (s *SpoolStore) replayBackground() {
+	if s.replaying != nil || len(s.files) == 0 {
+		return
+	}
+	done := make(chan struct{})
+	s.replaying = done
+	go func() {
+		defer close(done)
+		s.rmu.Lock()
+		defer s.rmu.Unlock()
+		s.replay(done)
+	}()
+}
+
+// Run replays spooled requests in the background on every interval until ctx is done
+func (s *SpoolStore) Run(ctx context.Context) {
+	interval := s.Interval
+	if interval <= 0 {
+		interval = DefaultSyncInterval
+	}
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+			s.mu.Lock()
+			s.replayBackground()
+			s.mu.Unlock()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Replay stores spooled requests upstream in order
+//
+// It waits for any background replay and then stops at the first retryable upstream error and returns it.
+func (s *SpoolStore) Replay() error {
+	s.mu.Lock()
+	done := s.replaying
+	s.mu.Unlock()
+	if done != nil {
+		<-done
+	}
+	s.rmu.Lock()
+	defer s.rmu.Unlock()
+	return s.replay(nil)
+}
+
+// Len returns the number of spooled requests
+func (s *SpoolStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.files)
+}
+
+// Size returns the total size in bytes of spooled requests
+func (s *SpoolStore) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+// Dropped returns the number of spooled requests dropped due to size or age limits
+func (s *SpoolStore) Dropped() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dropped
+}
+
+// Rejected returns the number of spooled requests rejected by the upstream store
+func (s *SpoolStore) Rejected() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rejected
+}
+
+// replay stores spooled requests upstream until none are left or upstream fails with a retryable error
+//
+// It must be called holding rmu. If done is the current background replay
+// it is cleared when replay returns.
+func (s *SpoolStore) replay(done chan struct{}) error {
+	for {
+		s.mu.Lock()
+		if len(s.files) == 0 {
+			s.clearReplaying(done)
+			s.mu.Unlock()
+			return nil
+		}
+		f := s.files[0]
+		s.mu.Unlock()
+		req, err := s.read(f)
+		// Corrupt files can never be replayed
+		drop := err != nil || s.expired(req.Time)
+		rejected := false
+		if !drop {
+			err := s.Upstream.Store(req)
+			if err != nil && !errors.Is(err, ErrDuplicate) {
+				if retryable(err) {
+					s.mu.Lock()
+					s.clearReplaying(done)
+					s.mu.Unlock()
+					return err
+				}
+				rejected = true
+			}
+		}
+		s.mu.Lock()
+		// The file may have been dropped due to MaxSize while it was replayed
+		if len(s.files) > 0 && s.files[0].seq == f.seq {
+			if rejected {
+				s.reject()
+			} else {
+				s.remove()
+			}
+			if drop {
+				s.dropped++
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *SpoolStore) clearReplaying(done chan struct{}) {
+	if done != nil && s.replaying == done {
+		s.replaying = nil
+	}
+}
+
+func (s *SpoolStore) expired(tm time.Time) bool {
+	return s.MaxAge > 0 && time.Since(tm) > s.MaxAge
+}
+
+func (s *SpoolStore) read(f spoolFile) (*StoreRequest, error) {
+	data, err := ioutil.ReadFile(filepath.Join(s.Dir, f.name))
+	if err != nil {
+		return nil, err
+	}
+	req := StoreRequest{}
+	if err := json.Unmarshal(data, &req); err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+// remove removes the oldest spooled request
+func (s *SpoolStore) remove() {
+	f := s.files[0]
+	os.Remove(filepath.Join(s.Dir, f.name))
+	s.pop()
+}
+
+// reject moves the oldest spooled request to the rejected directory
+func (s *SpoolStore) reject() {
+	f := s.files[0]
+	dir := filepath.Join(s.Dir, spoolRejectedDir)
+	if err := os.MkdirAll(dir, 0700); err != nil || os.Rename(filepath.Join(s.Dir, f.name), filepath.Join(dir, f.name)) != nil {
+		os.Remove(filepath.Join(s.Dir, f.name))
+	}
+	s.pop()
+	s.rejected++
+}
+
+func (s *SpoolStore) pop() {
+	f := s.files[0]
+	s.files[0] = spoolFile{}
+	s.files = s.files[1:]
+	s.size -= f.size
+}
+
+func (s *SpoolStore) spool(req *StoreRequest) error {
+	if req.Time.IsZero() {
+		r := *req
+		r.Time = time.Now()
+		req = &r
+	}
+	if s.expired(req.Time) {
+		s.dropped++
+		return nil
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	size := int64(len(data))
+	if s.MaxSize > 0 && size > s.MaxSize {
+		return fmt.Errorf("Request size %d exceeds spool max size %d", size, s.MaxSize)
+	}
+	f := spoolFile{
+		name: fmt.Sprintf("%020d%s", s.seq, spoolFileExt),
+		size: size,
+		seq:  s.seq,
+	}
+	if err := writeFileSync(filepath.Join(s.Dir, f.name), data); err != nil {
+		return err
+	}
+	s.seq++
+	s.files = append(s.files, f)
+	s.size += size
+	for s.MaxSize > 0 && s.size > s.MaxSize {
+		s.remove()
+		s.dropped++
+	}
+	return nil
+}
+
+// writeFileSync atomically writes a file syncing it to disk
+func writeFileSync(filename string, data []byte) error {
+	tmp := filename + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmp, filename)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if dir, err := os.Open(filepath.Dir(filename)); err == nil {
+		// Persist the rename, not supported on all platforms
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package meter_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	meter "github.com/alxarch/go-meter/v2"
+)
+
+func TestSpoolStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "meter-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	db := &testStore{fail: true}
+	var reject int32
+	handler := meter.StoreHandler(db)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&reject) == 1 {
+			code := http.StatusBadRequest
+			http.Error(w, http.StatusText(code), code)
+			return
+		}
+		handler(w, r)
+	}))
+	defer srv.Close()
+	upstream := &meter.HTTPStore{URL: srv.URL}
+
+	s, err := meter.NewSpoolStore(dir, upstream)
+	AssertNil(t, err)
+	now := time.Now().Truncate(time.Second)
+	store := func(s *meter.SpoolStore, event string, tm time.Time) {
+		t.Helper()
+		AssertNil(t, s.Store(&meter.StoreRequest{
+			Event:    event,
+			Time:     tm,
+			Labels:   []string{"color"},
+			Counters: meter.Snapshot{{Values: []string{"blue"}, Count: 1}},
+		}))
+	}
+	store(s, "foo", now)
+	store(s, "bar", now)
+	Assert(t, s.Replay() != nil, "Replay did not fail")
+	AssertEqual(t, s.Len(), 2)
+
+	// Restart with the upstream recovered
+	s, err = meter.NewSpoolStore(dir, upstream)
+	AssertNil(t, err)
+	AssertEqual(t, s.Len(), 2)
+	db.setFail(false)
+	store(s, "baz", now)
+	AssertNil(t, s.Replay())
+	AssertEqual(t, s.Len(), 0)
+	AssertEqual(t, s.Size(), int64(0))
+	AssertEqual(t, len(db.data), 3)
+	for i, event := range []string{"foo", "bar", "baz"} {
+		AssertEqual(t, db.data[i].Event, event)
+		Assert(t, db.data[i].Time.Equal(now), "Invalid time %s", db.data[i].Time)
+	}
+
+	// Size and age limits
+	db.setFail(true)
+	s.MaxAge = time.Hour
+	store(s, "old", now.Add(-2*time.Hour))
+	AssertEqual(t, s.Len(), 0)
+	store(s, "foo", now)
+	Assert(t, s.Replay() != nil, "Replay did not fail")
+	s.MaxSize = s.Size() * 2
+	store(s, "bar", now)
+	store(s, "baz", now)
+	Assert(t, s.Replay() != nil, "Replay did not fail")
+	AssertEqual(t, s.Len(), 2)
+	AssertEqual(t, s.Dropped(), int64(2))
+	db.setFail(false)
+	AssertNil(t, s.Replay())
+	AssertEqual(t, len(db.data), 5)
+	AssertEqual(t, db.data[3].Event, "bar")
+	AssertEqual(t, db.data[4].Event, "baz")
+
+	// Rejected requests are not spooled
+	atomic.StoreInt32(&reject, 1)
+	Assert(t, s.Store(&meter.StoreRequest{Event: "foo", Time: now}) != nil, "Rejected request spooled")
+	AssertEqual(t, s.Len(), 0)
+	// Spooled requests rejected on replay are moved aside
+	atomic.StoreInt32(&reject, 0)
+	db.setFail(true)
+	store(s, "foo", now)
+	store(s, "bar", now)
+	atomic.StoreInt32(&reject, 1)
+	AssertNil(t, s.Replay())
+	AssertEqual(t, s.Len(), 0)
+	AssertEqual(t, s.Rejected(), int64(2))
+	rejected, err := ioutil.ReadDir(filepath.Join(dir, "rejected"))
+	AssertNil(t, err)
+	AssertEqual(t, len(rejected), 2)
+
+	// Idle spools are replayed periodically
+	atomic.StoreInt32(&reject, 0)
+	store(s, "foo", now)
+	Assert(t, s.Replay() != nil, "Replay did not fail")
+	db.setFail(false)
+	s.Interval = time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.Run(ctx)
+	deadline := time.Now().Add(5 * time.Second)
+	for s.Len() > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	AssertEqual(t, s.Len(), 0)
+	AssertEqual(t, len(db.data), 6)
+}
@@ -0,0 +1,216 @@
+package meter
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// StatsdMapping maps a StatsD counter to an event
+type StatsdMapping struct {
+	// Metric is the StatsD metric name
+	Metric string `json:"metric"`
+	// Event is the name of the event, defaults to Metric
+	Event string `json:"event,omitempty"`
+	// Labels are the labels of the event
+	Labels []string `json:"labels"`
+	// TagMap maps event labels to tag names, unmapped labels use the same name
+	TagMap map[string]string `json:"tag_map,omitempty"`
+}
+
+// StatsdListener aggregates StatsD counters into Events synced to a store on an interval
+//
+// Counter lines with DogStatsD tags and sample rates are supported, other metric types are ignored.
+// Fractions of counts scaled by sample rates are carried over to the next line of the same series.
+type StatsdListener struct {
+	// Ignored counts lines of unmapped metrics or unsupported types, accessed atomically
+	Ignored int64
+	// Invalid counts lines that failed to parse, accessed atomically
+	Invalid int64
+
+	*Registry
+	metrics map[string]*statsdMetric
+}
+
+type statsdMetric struct {
+	event  *Event
+	labels []string
+
+	mu sync.Mutex
+	// frac is the fractional remainder of sampled counts of each series
+	frac map[string]float64
+}
+
+// add adds a fractional count to the event carrying the fraction of the series to the next line
+func (m *statsdMetric) add(v float64, values []string) {
+	key := strings.Join(values, "\x00")
+	m.mu.Lock()
+	v += m.frac[key]
+	// Tolerate rounding errors of rates like 0.3
+	n := math.Floor(v + 1e-9)
+	if frac := v - n; frac > 1e-9 {
+		if m.frac == nil {
+			m.frac = make(map[string]float64)
+		}
+		m.frac[key] = frac
+	} else {
+		delete(m.frac, key)
+	}
+	m.mu.Unlock()
+	if n != 0 {
+		m.event.Add(int64(n), values...)
+	}
+}
+
+// NewStatsdListener creates a StatsdListener syncing events to db on every interval
+func NewStatsdListener(db EventStore, interval time.Duration, mappings ...StatsdMapping) (*StatsdListener, error) {
+	l := StatsdListener{
+		Registry: NewRegistry(db, interval),
+		metrics:  make(map[string]*statsdMetric, len(mappings)),
+	}
+	for _, m := range mappings {
+		name := m.Event
+		if name == "" {
+			name = m.Metric
+		}
+		e := l.Registry.Get(name)
+		if e == nil {
+			e = NewEvent(name, m.Labels...)
+			if err := l.Register(e); err != nil {
+				return nil, err
+			}
+		} else if !stringsEqual(e.Labels, m.Labels) {
+			return nil, errors.New("Conflicting labels for event " + strconv.Quote(name))
+		}
+		tags := make([]string, len(m.Labels))
+		for i, label := range m.Labels {
+			if tag, ok := m.TagMap[label]; ok {
+				label = tag
+			}
+			tags[i] = label
+		}
+		l.metrics[m.Metric] = &statsdMetric{
+			event:  e,
+			labels: tags,
+		}
+	}
+	return &l, nil
+}
+
+var errInvalidStatsd = errors.New("Invalid StatsD line")
+
+// HandleLine parses a StatsD line adding counters to the mapped event
+func (l *StatsdListener) HandleLine(line []byte) error {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 {
+		return nil
+	}
+	i := bytes.IndexByte(line, ':')
+	if i <= 0 {
+		atomic.AddInt64(&l.Invalid, 1)
+		return errInvalidStatsd
+	}
+	name, sections := line[:i], bytes.Split(line[i+1:], []byte{'|'})
+	if len(sections) < 2 {
+		atomic.AddInt64(&l.Invalid, 1)
+		return errInvalidStatsd
+	}
+	m := l.metrics[string(name)]
+	if m == nil || string(sections[1]) != "c" {
+		atomic.AddInt64(&l.Ignored, 1)
+		return nil
+	}
+	v, err := strconv.ParseFloat(string(sections[0]), 64)
+	if err != nil {
+		atomic.AddInt64(&l.Invalid, 1)
+		return errInvalidStatsd
+	}
+	rate := 1.0
+	var tags []byte
+	for _, s := range sections[2:] {
+		switch {
+		case len(s) > 1 && s[0] == '@':
+			rate, err = strconv.ParseFloat(string(s[1:]), 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				atomic.AddInt64(&l.Invalid, 1)
+				return errInvalidStatsd
+			}
+		case len(s) > 0 && s[0] == '#':
+			tags = s[1:]
+		}
+	}
+	var buf [8]string
+	values := buf[:0]
+	for _, label := range m.labels {
+		values = append(values, statsdTag(tags, label))
+	}
+	if v /= rate; v != math.Trunc(v) {
+		m.add(v, values)
+	} else if v != 0 {
+		m.event.Add(int64(v), values...)
+	}
+	return nil
+}
+
+// statsdTag returns the value of a tag in a comma separated list of name:value tags
+func statsdTag(tags []byte, name string) string {
+	for len(tags) > 0 {
+		tag := tags
+		if i := bytes.IndexByte(tags, ','); i != -1 {
+			tag, tags = tags[:i], tags[i+1:]
+		} else {
+			tags = nil
+		}
+		value := []byte(nil)
+		if i := bytes.IndexByte(tag, ':'); i != -1 {
+			tag, value = tag[:i], tag[i+1:]
+		}
+		if string(tag) == name {
+			return string(value)
+		}
+	}
+	return ""
+}
+
+// StatsdStopTimeout is the max time the final sync of StatsdListener.Serve may take
+const StatsdStopTimeout = 10 * time.Second
+
+// Serve reads StatsD packets from conn until ctx is done or conn fails
+//
+// Events are synced in the background while serving and a final sync is done on return.
+// The error of the final sync is returned if serving did not fail.
+func (l *StatsdListener) Serve(ctx context.Context, conn net.PacketConn) (err error) {
+	l.Start()
+	defer func() {
+		stopCtx, cancel := context.WithTimeout(context.Background(), StatsdStopTimeout)
+		defer cancel()
+		if stopErr := l.Stop(stopCtx); err == nil {
+			err = stopErr
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	buf := make([]byte, 65535)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		for _, line := range bytes.Split(buf[:n], []byte{'\n'}) {
+			// Invalid lines are counted in Invalid
+			l.HandleLine(line)
+		}
+	}
+}
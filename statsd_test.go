@@ -0,0 +1,98 @@
+package meter_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	meter "github.com/alxarch/go-meter/v2"
+)
+
+func TestStatsdListener(t *testing.T) {
+	db := &testStore{}
+	l, err := meter.NewStatsdListener(db, time.Hour,
+		meter.StatsdMapping{
+			Metric: "api.requests",
+			Event:  "requests",
+			Labels: []string{"status", "route"},
+			TagMap: map[string]string{"status": "code"},
+		},
+		meter.StatsdMapping{
+			Metric: "jobs",
+		},
+	)
+	AssertNil(t, err)
+	AssertNil(t, l.HandleLine([]byte("api.requests:1|c|#code:200,route:/foo")))
+	AssertNil(t, l.HandleLine([]byte("api.requests:2|c|@0.5|#route:/foo,code:200")))
+	AssertNil(t, l.HandleLine([]byte("api.requests:1|c|#code:500")))
+	AssertNil(t, l.HandleLine([]byte("jobs:3|c")))
+	AssertNil(t, l.HandleLine([]byte("api.latency:320|ms|#code:200")))
+	AssertNil(t, l.HandleLine([]byte("api.requests:5|g")))
+	Assert(t, l.HandleLine([]byte("api.requests|c")) != nil, "Invalid line parsed")
+	Assert(t, l.HandleLine([]byte("api.requests:x|c")) != nil, "Invalid line parsed")
+	AssertEqual(t, l.Ignored, int64(2))
+	AssertEqual(t, l.Invalid, int64(2))
+	// Fractions of sampled counts are carried over
+	for i := 0; i < 3; i++ {
+		AssertNil(t, l.HandleLine([]byte("api.requests:1|c|@0.3|#code:429")))
+	}
+	AssertEqual(t, l.Get("requests").Add(0, "429", ""), int64(10))
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- l.Serve(ctx, conn)
+	}()
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Write([]byte("jobs:1|c\njobs:1|c|@0.1\n"))
+	client.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for l.Get("jobs").Add(0) != 14 {
+		if time.Now().After(deadline) {
+			t.Fatal("Timeout waiting for StatsD packets")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	AssertNil(t, <-done)
+
+	AssertEqual(t, len(db.data), 2)
+	for _, req := range db.data {
+		switch req.Event {
+		case "requests":
+			AssertEqual(t, req.Labels, []string{"status", "route"})
+			AssertSnapshot(t, req.Counters, meter.Snapshot{
+				{Values: []string{"200", "/foo"}, Count: 5},
+				{Values: []string{"429", ""}, Count: 10},
+				{Values: []string{"500", ""}, Count: 1},
+			})
+		case "jobs":
+			AssertSnapshot(t, req.Counters, meter.Snapshot{{Values: []string{}, Count: 14}})
+		default:
+			t.Errorf("Invalid event %q", req.Event)
+		}
+	}
+}
+
+func TestStatsdListener_Stop(t *testing.T) {
+	db := &testStore{fail: true}
+	l, err := meter.NewStatsdListener(db, time.Hour, meter.StatsdMapping{Metric: "jobs"})
+	AssertNil(t, err)
+	AssertNil(t, l.HandleLine([]byte("jobs:1|c")))
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// The error of the final sync is returned
+	Assert(t, l.Serve(ctx, conn) != nil, "Final sync did not fail")
+}
@@ -1,24 +1,34 @@
 package meter
 
 import (
+	"bufio"
 	"bytes"
 	"compress/flate"
 	"compress/gzip"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
 	"net/http"
 	"sort"
+	"strconv"
 	"sync"
 	"time"
 )
 
 // StoreRequest is a request to store a snapshot of an Event
 type StoreRequest struct {
+	// ID is an optional idempotency key, stores ignore requests with a recently seen ID
+	ID       string    `json:"id,omitempty"`
 	Event    string    `json:"event"`
 	Time     time.Time `json:"time,omitempty"`
 	Labels   []string  `json:"labels"`
+	Kind     Kind      `json:"kind,omitempty"`
 	Counters Snapshot  `json:"counters"`
 }
 
@@ -27,6 +37,63 @@ type EventStore interface {
 	Store(req *StoreRequest) error
 }
 
+// ErrDuplicate is returned by stores for requests with an already stored ID
+var ErrDuplicate = errors.New("Duplicate request")
+
+// NewRequestID creates a random StoreRequest ID
+func NewRequestID() string {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(id[:])
+}
+
+// requestGroups groups counters into StoreRequests by event, labels and time
+type requestGroups struct {
+	reqs  []StoreRequest
+	index map[string]int
+	key   []byte
+}
+
+// add adds a counter with fields sorted by label returning the index of its request
+func (g *requestGroups) add(event string, tm time.Time, fields Fields, n int64) int {
+	g.key = append(g.key[:0], event...)
+	for _, f := range fields {
+		g.key = append(g.key, 0)
+		g.key = append(g.key, f.Label...)
+	}
+	g.key = append(g.key, 0)
+	g.key = strconv.AppendInt(g.key, tm.Unix(), 10)
+	i, ok := g.index[string(g.key)]
+	if !ok {
+		if g.index == nil {
+			g.index = make(map[string]int)
+		}
+		i = len(g.reqs)
+		g.index[string(g.key)] = i
+		labels := make([]string, len(fields))
+		for j, f := range fields {
+			labels[j] = f.Label
+		}
+		g.reqs = append(g.reqs, StoreRequest{
+			Event:  event,
+			Time:   tm,
+			Labels: labels,
+		})
+	}
+	values := make([]string, len(fields))
+	for j, f := range fields {
+		values[j] = f.Value
+	}
+	req := &g.reqs[i]
+	req.Counters = append(req.Counters, Counter{
+		Values: values,
+		Count:  n,
+	})
+	return i
+}
+
 // InflateRequest middleware inflates request body
 func InflateRequest(next http.Handler) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -47,42 +114,333 @@ func InflateRequest(next http.Handler) http.HandlerFunc {
 	}
 }
 
+// StoreResult is the result of a StoreRequest in a batch
+type StoreResult struct {
+	Event  string `json:"event"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// Code is the HTTP status code of a failed request if it was sent alone
+	Code      int  `json:"code,omitempty"`
+	Duplicate bool `json:"duplicate,omitempty"`
+}
+
+// StoreResponse is the response of a StoreHandler
+type StoreResponse struct {
+	Status    string        `json:"status"`
+	Duplicate bool          `json:"duplicate,omitempty"`
+	Results   []StoreResult `json:"results,omitempty"`
+}
+
+// Statuses of StoreResult and StoreResponse
+const (
+	StatusOK    = "OK"
+	StatusError = "error"
+)
+
 // StoreHandler returns an HTTP endpoint for an EventStore
+//
+// The body is either a single StoreRequest, a JSON array or an NDJSON stream of StoreRequests.
+// Batches of requests are answered with a StoreResponse with a result for each request.
+// The client certificate identity set by ClientCertFields is added as a label to all requests.
 func StoreHandler(s EventStore) http.HandlerFunc {
 	handler := func(w http.ResponseWriter, r *http.Request) {
 		defer r.Body.Close()
-		req := StoreRequest{}
-		dec := json.NewDecoder(r.Body)
-		if err := dec.Decode(&req); err != nil {
+		reqs, batch, err := decodeStoreRequests(r)
+		if err != nil {
 			code := http.StatusBadRequest
+			if err == errBodyTooLarge {
+				code = http.StatusRequestEntityTooLarge
+			}
 			http.Error(w, http.StatusText(code), code)
 			return
 		}
-		if req.Time.IsZero() {
-			req.Time = time.Now()
-		}
-		if err := s.Store(&req); err != nil {
-			code := http.StatusInternalServerError
-			http.Error(w, http.StatusText(code), code)
+		now := time.Now()
+		ctx := r.Context()
+		if !batch {
+			err := storeRequest(ctx, s, &reqs[0], now)
+			switch {
+			case err == nil:
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"status":"OK"}`))
+			case errors.Is(err, ErrDuplicate):
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"status":"OK","duplicate":true}`))
+			default:
+				code := errorStatus(err)
+				http.Error(w, http.StatusText(code), code)
+			}
 			return
 		}
+		res := StoreResponse{
+			Status:  StatusOK,
+			Results: make([]StoreResult, len(reqs)),
+		}
+		for i := range reqs {
+			req := &reqs[i]
+			result := &res.Results[i]
+			result.Event = req.Event
+			result.Status = StatusOK
+			if err := storeRequest(ctx, s, req, now); errors.Is(err, ErrDuplicate) {
+				result.Duplicate = true
+			} else if err != nil {
+				result.Status = StatusError
+				result.Error = err.Error()
+				result.Code = errorStatus(err)
+				res.Status = StatusError
+			}
+		}
 		w.Header().Set("Content-Type", "application/json")
-		w.Write([]byte(`{"status":"OK"}`))
+		json.NewEncoder(w).Encode(&res)
 	}
 	return InflateRequest(http.HandlerFunc(handler))
 }
 
+var errForbidden = errors.New(http.StatusText(http.StatusForbidden))
+
+// errorStatus returns the HTTP status code of a request that failed to store
+func errorStatus(err error) int {
+	var missing errMissingEvent
+	switch {
+	case errors.Is(err, errForbidden):
+		return http.StatusForbidden
+	case errors.As(err, &missing):
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// statusError is an error of a request a remote store responded to with an HTTP status code
+type statusError struct {
+	code int
+	msg  string
+}
+
+func (e *statusError) Error() string {
+	return e.msg
+}
+
+// retryable checks if a request that failed to store may succeed if it is resent
+//
+// Requests rejected by a remote store with a 4xx status, forbidden requests and
+// requests of missing events are not retryable.
+func retryable(err error) bool {
+	var (
+		status  *statusError
+		missing errMissingEvent
+	)
+	switch {
+	case errors.As(err, &status):
+		return status.code >= http.StatusInternalServerError
+	case errors.As(err, &missing), errors.Is(err, errForbidden):
+		return false
+	default:
+		return true
+	}
+}
+
+// storeRequest validates and stores a request received by an endpoint
+//
+// Fields in ctx are added as labels and requests without a time are stored at now.
+// Events not allowed by the token in ctx are not stored and errForbidden is returned.
+func storeRequest(ctx context.Context, s EventStore, req *StoreRequest, now time.Time) error {
+	if req.Time.IsZero() {
+		req.Time = now
+	}
+	req.addCertField(ctx)
+	if !allow(ctx, ScopeWrite, req.Event) {
+		return errForbidden
+	}
+	return s.Store(req)
+}
+
+// maxBinaryBodySize is the max size of binary encoded request bodies
+const maxBinaryBodySize = 32 << 20
+
+var errBodyTooLarge = errors.New(http.StatusText(http.StatusRequestEntityTooLarge))
+
+// decodeStoreRequests decodes all StoreRequests in a request body
+//
+// It reports whether the body is a batch of requests.
+func decodeStoreRequests(r *http.Request) ([]StoreRequest, bool, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == ContentTypeBinary {
+		data, err := ioutil.ReadAll(io.LimitReader(r.Body, maxBinaryBodySize+1))
+		if err != nil {
+			return nil, false, err
+		}
+		if len(data) > maxBinaryBodySize {
+			return nil, false, errBodyTooLarge
+		}
+		return decodeStoreRequestsBinary(data)
+	}
+	body := bufio.NewReader(r.Body)
+	dec := json.NewDecoder(body)
+	if c, err := peekNonSpace(body); err != nil {
+		return nil, false, err
+	} else if c == '[' {
+		var reqs []StoreRequest
+		if err := dec.Decode(&reqs); err != nil {
+			return nil, false, err
+		}
+		return reqs, true, nil
+	}
+	var reqs []StoreRequest
+	for {
+		req := StoreRequest{}
+		if err := dec.Decode(&req); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, false, err
+		}
+		reqs = append(reqs, req)
+	}
+	if len(reqs) == 0 {
+		return nil, false, io.ErrUnexpectedEOF
+	}
+	batch := len(reqs) > 1 || mediaType == "application/x-ndjson"
+	return reqs, batch, nil
+}
+
+func peekNonSpace(r *bufio.Reader) (byte, error) {
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		switch c {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+		return c, r.UnreadByte()
+	}
+}
+
 // HTTPStore is a remote EventStore over HTTP
+//
+// An HTTPStore batches requests so it must be used by pointer and not copied after first use.
 type HTTPStore struct {
 	*http.Client
 	URL string
+	// Batch is the time window to coalesce requests into a single batch call
+	// Store blocks until the batch is sent. Zero disables batching.
+	Batch time.Duration
+	// MaxBatch is the max number of requests in a batch, zero means no limit
+	MaxBatch int
+	// Binary sends requests using the binary encoding instead of JSON
+	Binary bool
+	// Retries is the number of times a request is resent on transport errors or 5xx responses
+	// Requests are resent with the same ID so that retries are not stored twice.
+	Retries int
+	// RetryDelay is the delay before the first retry, defaults to DefaultRetryDelay
+	// It doubles on each retry.
+	RetryDelay time.Duration
+	// Auth authenticates requests
+	Auth ClientAuth
+
+	mu      sync.Mutex
+	pending *storeBatch
+}
+
+type storeBatch struct {
+	once sync.Once
+	reqs []*StoreRequest
+	errs []error
+	done chan struct{}
 }
 
 // Store implements EventStore interface
-func (c *HTTPStore) Store(r *StoreRequest) (err error) {
+func (c *HTTPStore) Store(r *StoreRequest) error {
+	if c.Batch <= 0 {
+		return c.post(nil, r)
+	}
+	c.mu.Lock()
+	b := c.pending
+	if b == nil {
+		b = &storeBatch{
+			done: make(chan struct{}),
+		}
+		c.pending = b
+		time.AfterFunc(c.Batch, func() {
+			c.flush(b)
+		})
+	}
+	i := len(b.reqs)
+	b.reqs = append(b.reqs, r)
+	full := c.MaxBatch > 0 && len(b.reqs) >= c.MaxBatch
+	c.mu.Unlock()
+	if full {
+		c.flush(b)
+	}
+	<-b.done
+	return b.errs[i]
+}
+
+func (c *HTTPStore) flush(b *storeBatch) {
+	b.once.Do(func() {
+		c.mu.Lock()
+		if c.pending == b {
+			c.pending = nil
+		}
+		c.mu.Unlock()
+		b.errs = make([]error, len(b.reqs))
+		res := StoreResponse{}
+		err := c.post(&res, b.reqs...)
+		for i := range b.errs {
+			switch {
+			case err != nil:
+				b.errs[i] = err
+			case i >= len(res.Results):
+				b.errs[i] = errors.New("Missing batch result")
+			case res.Results[i].Status != StatusOK:
+				result := &res.Results[i]
+				if result.Code != 0 {
+					b.errs[i] = &statusError{code: result.Code, msg: result.Error}
+				} else {
+					b.errs[i] = errors.New(result.Error)
+				}
+			}
+		}
+		close(b.done)
+	})
+}
+
+// DefaultRetryDelay is the default delay before the first retry of an HTTPStore request
+const DefaultRetryDelay = 100 * time.Millisecond
+
+// post posts requests to the remote store retrying on transport and server errors
+func (c *HTTPStore) post(res *StoreResponse, reqs ...*StoreRequest) (err error) {
+	delay := c.RetryDelay
+	if delay <= 0 {
+		delay = DefaultRetryDelay
+	}
+	for i := 0; ; i++ {
+		var retry bool
+		if retry, err = c.postOnce(res, reqs...); err == nil || !retry || i >= c.Retries {
+			return
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// postOnce posts requests to the remote store
+//
+// Requests are sent as a batch if res is not nil and the response is decoded to res.
+// It reports whether a failed request can be retried.
+func (c *HTTPStore) postOnce(res *StoreResponse, reqs ...*StoreRequest) (retry bool, err error) {
 	body := getSyncBuffer()
 	defer putSyncBuffer(body)
-	err = body.Encode(r)
+	contentType := "application/json"
+	switch {
+	case c.Binary:
+		contentType = ContentTypeBinary
+		err = body.EncodeBinary(res != nil, reqs...)
+	case res != nil:
+		err = body.Encode(reqs)
+	default:
+		err = body.Encode(reqs[0])
+	}
 	if err != nil {
 		return
 	}
@@ -91,19 +449,29 @@ func (c *HTTPStore) Store(r *StoreRequest) (err error) {
 		return
 	}
 	req.Header.Set("Content-Encoding", "gzip")
-	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Type", contentType)
+	if c.Auth != nil {
+		c.Auth.AuthenticateRequest(req, body.buffer.Bytes())
+	}
 
 	client := c.Client
 	if client == nil {
 		client = http.DefaultClient
 	}
-	res, err := client.Do(req)
+	r, err := client.Do(req)
 	if err != nil {
-		return
+		return true, err
 	}
-	defer res.Body.Close()
-	if res.StatusCode != http.StatusOK {
-		err = fmt.Errorf("Invalid HTTP status: [%d] %s", res.StatusCode, res.Status)
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		err = &statusError{
+			code: r.StatusCode,
+			msg:  fmt.Sprintf("Invalid HTTP status: [%d] %s", r.StatusCode, r.Status),
+		}
+		return retryable(err), err
+	}
+	if res != nil {
+		err = json.NewDecoder(r.Body).Decode(res)
 	}
 	return
 }
@@ -112,6 +480,7 @@ type syncBuffer struct {
 	buffer bytes.Buffer
 	gzip   *gzip.Writer
 	json   *json.Encoder
+	data   []byte
 }
 
 var syncBuffers sync.Pool
@@ -128,12 +497,7 @@ func putSyncBuffer(b *syncBuffer) {
 }
 
 func (b *syncBuffer) Encode(x interface{}) error {
-	b.buffer.Reset()
-	if b.gzip == nil {
-		b.gzip = gzip.NewWriter(&b.buffer)
-	} else {
-		b.gzip.Reset(&b.buffer)
-	}
+	b.reset()
 	if b.json == nil {
 		b.json = json.NewEncoder(b.gzip)
 	}
@@ -143,6 +507,25 @@ func (b *syncBuffer) Encode(x interface{}) error {
 	return b.gzip.Close()
 }
 
+// EncodeBinary encodes requests using the binary encoding
+func (b *syncBuffer) EncodeBinary(batch bool, reqs ...*StoreRequest) error {
+	b.reset()
+	b.data = appendStoreRequests(b.data[:0], batch, reqs...)
+	if _, err := b.gzip.Write(b.data); err != nil {
+		return err
+	}
+	return b.gzip.Close()
+}
+
+func (b *syncBuffer) reset() {
+	b.buffer.Reset()
+	if b.gzip == nil {
+		b.gzip = gzip.NewWriter(&b.buffer)
+	} else {
+		b.gzip.Reset(&b.buffer)
+	}
+}
+
 // MemoryStore is an in-memory EventStore for debugging
 type MemoryStore struct {
 	data  []StoreRequest
@@ -165,7 +548,9 @@ func (m *MemoryStore) Store(req *StoreRequest) error {
 	}
 	last := m.Last()
 	if last == nil || req.Time.After(last.Time) {
-		m.data = append(m.data, *req)
+		r := *req
+		r.Counters = append(Snapshot(nil), req.Counters...)
+		m.data = append(m.data, r)
 		return nil
 	}
 	return errors.New("Invalid time")
@@ -221,6 +606,10 @@ func (m *MemoryStore) Scan(ctx context.Context, q *Query) ScanIterator {
 						Fields: fields,
 						Time:   stepTS(d.Time.Unix(), step),
 						Count:  c.Count,
+						Sum:    c.Sum,
+						Min:    c.Min,
+						Max:    c.Max,
+						Last:   c.Last,
 					}:
 					case <-done:
 						return
@@ -233,24 +622,61 @@ func (m *MemoryStore) Scan(ctx context.Context, q *Query) ScanIterator {
 }
 
 // SyncTask dumps an Event to an EventStore
+//
+// Counters of a request that fails with a retryable error are merged back to
+// the event and sent with the next sync. If no counters changed in the meantime
+// the request is resent with the same ID, so a store that committed it but failed
+// to respond ignores it as a duplicate. Counters of rejected requests are dropped.
 func (e *Event) SyncTask(db EventStore) func(time.Time) error {
+	var (
+		mu sync.Mutex
+		// failed is the last request that failed to store
+		failed StoreRequest
+	)
 	return func(tm time.Time) error {
+		mu.Lock()
+		defer mu.Unlock()
 		s := getSnapshot()
-		defer putSnapshot(s)
+		defer func() {
+			putSnapshot(s)
+		}()
 		if s = e.Flush(s[:0]); len(s) == 0 {
 			return nil
 		}
+		id := failed.ID
+		if id == "" || !sameCounters(failed.Counters, s) {
+			id = NewRequestID()
+		}
+		failed.ID, failed.Counters = "", failed.Counters[:0]
 		req := StoreRequest{
+			ID:       id,
 			Event:    e.Name,
 			Labels:   e.Labels,
+			Kind:     e.Kind,
 			Time:     tm,
 			Counters: s,
 		}
-		if err := db.Store(&req); err != nil {
-			e.Merge(s)
-			return err
+		err := db.Store(&req)
+		switch {
+		case err == nil, errors.Is(err, ErrDuplicate):
+			return nil
+		case retryable(err):
+			e.unflush(s)
+			failed.ID, failed.Counters = id, append(failed.Counters, s...)
 		}
-		return nil
+		return err
+	}
+}
 
+// sameCounters checks if two snapshots have the same counts in the same order
+func sameCounters(a, b Snapshot) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Count != b[i].Count || a[i].Sum != b[i].Sum || !a[i].Match(b[i].Values) {
+			return false
+		}
 	}
+	return true
 }
@@ -2,6 +2,12 @@ package meter_test
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -54,3 +60,139 @@ func Test_MemoryStore(t *testing.T) {
 	}
 
 }
+
+type storeFunc func(r *meter.StoreRequest) error
+
+func (f storeFunc) Store(r *meter.StoreRequest) error {
+	return f(r)
+}
+
+func TestStoreHandler_Batch(t *testing.T) {
+	db := &testStore{}
+	h := meter.StoreHandler(storeFunc(func(r *meter.StoreRequest) error {
+		if r.Event == "bad" {
+			return errors.New("Bad event")
+		}
+		return db.Store(r)
+	}))
+	post := func(contentType, body string) (int, meter.StoreResponse) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/events", strings.NewReader(body))
+		r.Header.Set("Content-Type", contentType)
+		h(w, r)
+		res := meter.StoreResponse{}
+		json.Unmarshal(w.Body.Bytes(), &res)
+		return w.Code, res
+	}
+	code, res := post("application/json", `{"event":"foo","labels":["color"],"counters":[{"n":1,"v":["blue"]}]}`)
+	AssertEqual(t, code, http.StatusOK)
+	AssertEqual(t, res.Status, meter.StatusOK)
+	AssertEqual(t, len(res.Results), 0)
+
+	code, res = post("application/json", ` [{"event":"foo"},{"event":"bad"},{"event":"bar"}]`)
+	AssertEqual(t, code, http.StatusOK)
+	AssertEqual(t, res, meter.StoreResponse{
+		Status: meter.StatusError,
+		Results: []meter.StoreResult{
+			{Event: "foo", Status: meter.StatusOK},
+			{Event: "bad", Status: meter.StatusError, Error: "Bad event", Code: http.StatusInternalServerError},
+			{Event: "bar", Status: meter.StatusOK},
+		},
+	})
+
+	code, res = post("application/x-ndjson", "{\"event\":\"foo\"}\n")
+	AssertEqual(t, code, http.StatusOK)
+	AssertEqual(t, res.Results, []meter.StoreResult{{Event: "foo", Status: meter.StatusOK}})
+
+	code, _ = post("application/json", `[{"event":"foo"},`)
+	AssertEqual(t, code, http.StatusBadRequest)
+	code, _ = post("application/json", ``)
+	AssertEqual(t, code, http.StatusBadRequest)
+	code, _ = post(meter.ContentTypeBinary, strings.Repeat("x", 33<<20))
+	AssertEqual(t, code, http.StatusRequestEntityTooLarge)
+	AssertEqual(t, len(db.data), 4)
+}
+
+func TestHTTPStore_Batch(t *testing.T) {
+	db := &testStore{}
+	var (
+		posts int64
+		bad   []string
+	)
+	handler := meter.StoreHandler(storeFunc(func(r *meter.StoreRequest) error {
+		if r.Event == "bad" {
+			bad = append(bad, r.ID)
+			return errors.New("Bad event")
+		}
+		return db.Store(r)
+	}))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&posts, 1)
+		handler(w, r)
+	}))
+	defer srv.Close()
+	s := &meter.HTTPStore{
+		URL:   srv.URL,
+		Batch: 50 * time.Millisecond,
+	}
+	r := meter.NewRegistry(s, time.Hour)
+	r.Concurrent = true
+	events := []*meter.Event{
+		meter.NewEvent("foo", "color"),
+		meter.NewEvent("bar", "color"),
+		meter.NewEvent("bad", "color"),
+	}
+	AssertNil(t, r.Register(events...))
+	for _, e := range events {
+		e.Add(1, "blue")
+	}
+	AssertEqual(t, r.Sync(time.Now()).Error(), "Bad event")
+	AssertEqual(t, atomic.LoadInt64(&posts), int64(1))
+	AssertEqual(t, len(db.data), 2)
+	// Failed requests are resent with the same ID
+	AssertEqual(t, r.Sync(time.Now()).Error(), "Bad event")
+	AssertEqual(t, len(bad), 2)
+	Assert(t, bad[0] != "" && bad[0] == bad[1], "Invalid request IDs %v", bad)
+	// Failed counters are merged back
+	AssertEqual(t, events[2].Flush(nil), meter.Snapshot{{Values: []string{"blue"}, Count: 1}})
+
+	s.MaxBatch = 1
+	AssertNil(t, s.Store(&meter.StoreRequest{Event: "foo", Time: time.Now()}))
+	AssertEqual(t, atomic.LoadInt64(&posts), int64(3))
+}
+
+func TestHTTPStore_Retries(t *testing.T) {
+	var (
+		posts  int64
+		status int64
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&posts, 1)
+		w.WriteHeader(int(atomic.LoadInt64(&status)))
+	}))
+	defer srv.Close()
+	s := &meter.HTTPStore{
+		URL:        srv.URL,
+		Retries:    2,
+		RetryDelay: time.Millisecond,
+	}
+	req := meter.StoreRequest{Event: "foo", Time: time.Now()}
+	atomic.StoreInt64(&status, http.StatusBadRequest)
+	Assert(t, s.Store(&req) != nil, "Store did not fail")
+	AssertEqual(t, atomic.LoadInt64(&posts), int64(1))
+	atomic.StoreInt64(&status, http.StatusServiceUnavailable)
+	Assert(t, s.Store(&req) != nil, "Store did not fail")
+	AssertEqual(t, atomic.LoadInt64(&posts), int64(4))
+
+	// Counters of rejected requests are dropped
+	e := meter.NewEvent("foo")
+	e.Add(1)
+	atomic.StoreInt64(&status, http.StatusBadRequest)
+	Assert(t, e.SyncTask(s)(time.Now()) != nil, "Sync did not fail")
+	AssertEqual(t, e.Flush(nil), meter.Snapshot{{Values: []string{}, Count: 0}})
+	e.Add(1)
+	atomic.StoreInt64(&status, http.StatusServiceUnavailable)
+	Assert(t, e.SyncTask(s)(time.Now()) != nil, "Sync did not fail")
+	AssertEqual(t, e.Flush(nil), meter.Snapshot{{Values: []string{}, Count: 1}})
+}
@@ -0,0 +1,257 @@
+package meter
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultTailPoll is the default interval a tailed file is checked for new lines
+const DefaultTailPoll = time.Second
+
+// StreamIngester stores StoreRequests read as newline delimited JSON from streams
+//
+// Each line is validated and stored like StoreHandler requests using the token
+// of the context. Streams without a token in the context can store all events.
+// Lines longer than 1MB are skipped and reported as errors.
+type StreamIngester struct {
+	// Store is the EventStore requests are stored to
+	Store EventStore
+	// OnError is called for each line that fails to parse or store
+	OnError func(source string, err *LineError)
+	// Poll is the interval a tailed file is checked for new lines, defaults to DefaultTailPoll
+	Poll time.Duration
+}
+
+// maxLineSize is the max size of a stream line
+const maxLineSize = 1 << 20
+
+var errLineTooLong = errors.New("Line too long")
+
+// lineReader reads lines of at most maxLineSize bytes
+type lineReader struct {
+	rd   *bufio.Reader
+	line []byte
+	// long is set when the line exceeds maxLineSize, the rest of the line is discarded
+	long bool
+}
+
+// next reads the rest of the current line
+//
+// Partial lines are kept on errors and completed by the next call.
+func (r *lineReader) next() error {
+	for {
+		chunk, err := r.rd.ReadSlice('\n')
+		if !r.long {
+			size := len(r.line) + len(bytes.TrimSuffix(chunk, []byte{'\n'}))
+			if size > maxLineSize {
+				r.long, r.line = true, r.line[:0]
+			} else {
+				r.line = append(r.line, chunk...)
+			}
+		}
+		if err != bufio.ErrBufferFull {
+			return err
+		}
+	}
+}
+
+func (r *lineReader) pending() bool {
+	return len(r.line) > 0 || r.long
+}
+
+func (r *lineReader) reset() {
+	r.line, r.long = r.line[:0], false
+}
+
+// Ingest stores all lines of r until EOF
+//
+// Source identifies r in errors.
+func (s *StreamIngester) Ingest(ctx context.Context, source string, r io.Reader) error {
+	rd := lineReader{rd: bufio.NewReader(r)}
+	for n := 1; ; n++ {
+		err := rd.next()
+		if rd.pending() {
+			s.handleLine(ctx, source, n, &rd)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *StreamIngester) handleLine(ctx context.Context, source string, n int, rd *lineReader) {
+	defer rd.reset()
+	if rd.long {
+		if s.OnError != nil {
+			s.OnError(source, &LineError{Line: n, Err: errLineTooLong})
+		}
+		return
+	}
+	line := bytes.TrimSpace(rd.line)
+	if len(line) == 0 {
+		return
+	}
+	req := StoreRequest{}
+	err := json.Unmarshal(line, &req)
+	if err == nil {
+		err = storeRequest(ctx, s.Store, &req, time.Now())
+	}
+	if err != nil && !errors.Is(err, ErrDuplicate) && s.OnError != nil {
+		s.OnError(source, &LineError{Line: n, Err: err})
+	}
+}
+
+// TailFile stores lines appended to a file until ctx is done
+//
+// Like tail -F the file is reopened if it is rotated and read from the start if it is truncated.
+// A missing file is waited for. If fromStart is false lines already in the file are skipped.
+func (s *StreamIngester) TailFile(ctx context.Context, filename string, fromStart bool) error {
+	poll := s.Poll
+	if poll <= 0 {
+		poll = DefaultTailPoll
+	}
+	tick := time.NewTicker(poll)
+	defer tick.Stop()
+	wait := func() error {
+		select {
+		case <-tick.C:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	var f *os.File
+	for {
+		var err error
+		if f, err = os.Open(filename); err == nil {
+			break
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+		// Lines of a file created after tailing started are all new
+		fromStart = true
+		if wait() != nil {
+			return nil
+		}
+	}
+	defer func() {
+		f.Close()
+	}()
+	if !fromStart {
+		if _, err := f.Seek(0, io.SeekEnd); err != nil {
+			return err
+		}
+	}
+	var (
+		rd = lineReader{rd: bufio.NewReader(f)}
+		n  int
+	)
+	// read stores complete lines until EOF
+	read := func() error {
+		for {
+			if err := rd.next(); err != nil {
+				return err
+			}
+			n++
+			s.handleLine(ctx, filename, n, &rd)
+		}
+	}
+	for {
+		if err := read(); err != io.EOF {
+			return err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		offset, err := f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		switch current, err := os.Stat(filename); {
+		case err != nil:
+			// Wait for the rotated file to be created
+		case !os.SameFile(info, current):
+			next, err := os.Open(filename)
+			if err != nil {
+				break
+			}
+			// Lines written before the file was rotated
+			if err := read(); err != io.EOF {
+				next.Close()
+				return err
+			}
+			if rd.pending() {
+				n++
+				s.handleLine(ctx, filename, n, &rd)
+			}
+			f.Close()
+			f, n = next, 0
+			rd.rd.Reset(f)
+			continue
+		case info.Size() < offset:
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			n = 0
+			rd.reset()
+			rd.rd.Reset(f)
+			continue
+		}
+		if wait() != nil {
+			return nil
+		}
+	}
+}
+
+// Serve stores lines of connections accepted by l until ctx is done
+//
+// Connections are read concurrently and closed when ctx is done.
+func (s *StreamIngester) Serve(ctx context.Context, l net.Listener) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	source := l.Addr().String()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			done := make(chan struct{})
+			defer close(done)
+			go func() {
+				select {
+				case <-ctx.Done():
+					conn.Close()
+				case <-done:
+				}
+			}()
+			defer conn.Close()
+			s.Ingest(ctx, source, conn)
+		}()
+	}
+}
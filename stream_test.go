@@ -0,0 +1,179 @@
+package meter_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	meter "github.com/alxarch/go-meter/v2"
+)
+
+func TestStreamIngester_Ingest(t *testing.T) {
+	db := &testStore{}
+	var errs []*meter.LineError
+	s := meter.StreamIngester{
+		Store: db,
+		OnError: func(source string, err *meter.LineError) {
+			AssertEqual(t, source, "stdin")
+			errs = append(errs, err)
+		},
+	}
+	ctx := meter.ContextWithToken(context.Background(), &meter.Token{
+		Scopes: []string{meter.ScopeWrite},
+		Events: []string{"foo"},
+	})
+	ctx = meter.ContextWithFields(ctx, meter.Field{Label: "source", Value: "job"})
+	body := strings.Join([]string{
+		`{"event":"foo","time":"2019-01-01T00:00:00Z","labels":["color"],"counters":[{"v":["red"],"n":2}]}`,
+		``,
+		`{"event":"foo",`,
+		`{"event":"bar","labels":[],"counters":[{"v":[],"n":1}]}`,
+		`{"event":"foo","labels":[],"counters":[{"v":[],"n":1}]}`,
+		`{"event":"foo","labels":["color"],"counters":[{"v":["` + strings.Repeat("x", 1<<20) + `"],"n":1}]}`,
+		`{"event":"foo","labels":[],"counters":[{"v":[],"n":1}]}`,
+	}, "\n")
+	AssertNil(t, s.Ingest(ctx, "stdin", strings.NewReader(body)))
+	AssertEqual(t, len(errs), 3)
+	AssertEqual(t, errs[0].Line, 3)
+	AssertEqual(t, errs[1].Line, 4)
+	AssertEqual(t, errs[1].Error(), "Line 4: Forbidden")
+	// Long lines are skipped
+	AssertEqual(t, errs[2].Error(), "Line 6: Line too long")
+	AssertEqual(t, len(db.data), 3)
+	// Context fields are not stored
+	AssertEqual(t, db.data[0].Labels, []string{"color"})
+	AssertSnapshot(t, db.data[0].Counters, meter.Snapshot{{Values: []string{"red"}, Count: 2}})
+	AssertEqual(t, db.data[0].Time, time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC))
+	Assert(t, !db.data[1].Time.IsZero(), "No time set")
+}
+
+// waitStored waits until db has n requests
+func waitStored(t *testing.T, db *testStore, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		db.mu.Lock()
+		size := len(db.data)
+		db.mu.Unlock()
+		if size == n {
+			return
+		}
+		if size > n || time.Now().After(deadline) {
+			t.Fatalf("Invalid number of stored requests %d != %d", size, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestStreamIngester_TailFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "meter-tail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "events.ndjson")
+	line := func(n string) string {
+		return `{"event":"foo","labels":[],"counters":[{"v":[],"n":` + n + `}]}` + "\n"
+	}
+	appendFile := func(filename string, data string) {
+		f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteString(data)
+		f.Close()
+	}
+	appendFile(filename, line("1"))
+
+	db := &testStore{}
+	var (
+		mu   sync.Mutex
+		errs []*meter.LineError
+	)
+	s := meter.StreamIngester{
+		Store: db,
+		Poll:  time.Millisecond,
+		OnError: func(source string, err *meter.LineError) {
+			mu.Lock()
+			errs = append(errs, err)
+			mu.Unlock()
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- s.TailFile(ctx, filename, false)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	// Partial lines are completed
+	partial := line("2")
+	appendFile(filename, partial[:10])
+	time.Sleep(5 * time.Millisecond)
+	appendFile(filename, partial[10:]+"{\n")
+	waitStored(t, db, 1)
+	AssertEqual(t, db.data[0].Counters[0].Count, int64(2))
+
+	// Rotation
+	AssertNil(t, os.Rename(filename, filename+".1"))
+	appendFile(filename+".1", line("3"))
+	appendFile(filename, line("4"))
+	waitStored(t, db, 3)
+	AssertEqual(t, db.data[1].Counters[0].Count, int64(3))
+	AssertEqual(t, db.data[2].Counters[0].Count, int64(4))
+
+	// Truncation
+	AssertNil(t, os.Truncate(filename, 0))
+	time.Sleep(20 * time.Millisecond)
+	appendFile(filename, line("5"))
+	waitStored(t, db, 4)
+	AssertEqual(t, db.data[3].Counters[0].Count, int64(5))
+
+	cancel()
+	AssertNil(t, <-done)
+	mu.Lock()
+	defer mu.Unlock()
+	AssertEqual(t, len(errs), 1)
+	AssertEqual(t, errs[0].Line, 2)
+}
+
+func TestStreamIngester_Serve(t *testing.T) {
+	dir, err := ioutil.TempDir("", "meter-unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addr := filepath.Join(dir, "meter.sock")
+	l, err := net.Listen("unix", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := &testStore{}
+	s := meter.StreamIngester{Store: db}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- s.Serve(ctx, l)
+	}()
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("unix", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte(`{"event":"foo","labels":[],"counters":[{"v":[],"n":1}]}` + "\n"))
+		if i == 0 {
+			conn.Close()
+		} else {
+			defer conn.Close()
+		}
+	}
+	waitStored(t, db, 2)
+	// Open connections are closed
+	cancel()
+	AssertNil(t, <-done)
+}
@@ -0,0 +1,239 @@
+package meter
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"sync"
+)
+
+// CertReloader serves a TLS certificate and client CA bundle that can be reloaded from disk
+type CertReloader struct {
+	CertFile string
+	KeyFile  string
+	// ClientCAFile is the CA bundle verifying client certificates, set by ServerTLSConfig
+	ClientCAFile string
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+}
+
+// LoadCertReloader creates a CertReloader loading a certificate and key
+func LoadCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	r := CertReloader{
+		CertFile: certFile,
+		KeyFile:  keyFile,
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// Reload reloads the certificate and client CA bundle, the old ones are kept on error
+func (r *CertReloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(r.CertFile, r.KeyFile)
+	if err != nil {
+		return err
+	}
+	var pool *x509.CertPool
+	if r.ClientCAFile != "" {
+		if pool, err = loadCertPool(r.ClientCAFile); err != nil {
+			return err
+		}
+	}
+	r.mu.Lock()
+	r.cert = &cert
+	r.clientCAs = pool
+	r.mu.Unlock()
+	return nil
+}
+
+// GetCertificate can be used as tls.Config.GetCertificate
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// ServerTLSConfig creates a server TLS config
+//
+// If clientCAFile is not empty clients must present a certificate signed by it.
+// The client CA bundle is reloaded along with the certificate by certs.Reload.
+// Client certificates are verified by VerifyPeerCertificate so the config can
+// be cloned by http.Server to negotiate HTTP/2.
+func ServerTLSConfig(certs *CertReloader, clientCAFile string) (*tls.Config, error) {
+	config := tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certs.GetCertificate,
+	}
+	if clientCAFile != "" {
+		certs.ClientCAFile = clientCAFile
+		if err := certs.Reload(); err != nil {
+			return nil, err
+		}
+		config.ClientAuth = tls.RequireAnyClientCert
+		config.VerifyPeerCertificate = certs.verifyClientCert
+	}
+	return &config, nil
+}
+
+// verifyClientCert verifies a client certificate chain against the current client CA bundle
+func (r *CertReloader) verifyClientCert(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	r.mu.RLock()
+	roots := r.clientCAs
+	r.mu.RUnlock()
+	if roots == nil || len(rawCerts) == 0 {
+		return errors.New("No client certificate")
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs[i] = cert
+	}
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(opts)
+	return err
+}
+
+// ClientTLSConfig creates a client TLS config
+//
+// If caFile is empty the system roots are used.
+// If certFile is not empty the client certificate is sent to servers.
+func ClientTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	config := tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return &config, nil
+}
+
+func loadCertPool(filename string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("No certificates in " + filename)
+	}
+	return pool, nil
+}
+
+func newTLSClient(caFile, certFile, keyFile string) (*http.Client, error) {
+	config, err := ClientTLSConfig(caFile, certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = config
+	return &http.Client{Transport: tr}, nil
+}
+
+// NewTLSHTTPStore creates an HTTPStore using a CA bundle and a client certificate
+func NewTLSHTTPStore(url, caFile, certFile, keyFile string) (*HTTPStore, error) {
+	client, err := newTLSClient(caFile, certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &HTTPStore{
+		Client: client,
+		URL:    url,
+	}, nil
+}
+
+// NewTLSHTTPQueryRunner creates an HTTPQueryRunner using a CA bundle and a client certificate
+func NewTLSHTTPQueryRunner(url, caFile, certFile, keyFile string) (*HTTPQueryRunner, error) {
+	client, err := newTLSClient(caFile, certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &HTTPQueryRunner{
+		Client: client,
+		URL:    url,
+	}, nil
+}
+
+// ClientCertFields middleware adds the verified client certificate identity to the request context fields
+//
+// The identity is the certificate common name or its first DNS name.
+// The server TLS config must verify client certificates, like ServerTLSConfig does.
+// StoreHandler and the other ingest handlers add the identity as a label to stored requests,
+// other context fields are never stored.
+func ClientCertFields(label string, next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if id := clientCertIdentity(r); id != "" {
+			f := Field{Label: label, Value: id}
+			ctx := ContextWithFields(r.Context(), f)
+			ctx = context.WithValue(ctx, certFieldContextKey{}, f)
+			r = r.WithContext(ctx)
+		}
+		next.ServeHTTP(w, r)
+	}
+}
+
+// certFieldContextKey is the context key of the client certificate identity field
+type certFieldContextKey struct{}
+
+func clientCertIdentity(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+	cert := r.TLS.PeerCertificates[0]
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName
+	}
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0]
+	}
+	return ""
+}
+
+// addCertField sets the label of the client certificate identity set by ClientCertFields on a request
+//
+// The identity overrides values sent by the client.
+func (req *StoreRequest) addCertField(ctx context.Context) {
+	f, ok := ctx.Value(certFieldContextKey{}).(Field)
+	if !ok {
+		return
+	}
+	i := indexOf(req.Labels, f.Label)
+	if i == -1 {
+		i = len(req.Labels)
+		req.Labels = append(req.Labels[:i:i], f.Label)
+	}
+	for j := range req.Counters {
+		c := &req.Counters[j]
+		values := make([]string, len(req.Labels))
+		copy(values, c.Values)
+		values[i] = f.Value
+		c.Values = values
+	}
+}
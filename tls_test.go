@@ -0,0 +1,162 @@
+package meter_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	meter "github.com/alxarch/go-meter/v2"
+)
+
+// writeTestCert writes a certificate and key signed by parent to dir
+func writeTestCert(t *testing.T, dir, name string, tmpl *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := ioutil.WriteFile(filepath.Join(dir, name+".pem"), certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, name+"-key.pem"), keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "meter-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	now := time.Now()
+	ca, caKey := writeTestCert(t, dir, "ca", &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}, nil, nil)
+	writeTestCert(t, dir, "server", &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "meterd"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	writeTestCert(t, dir, "client", &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "collector-1"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+	file := func(name string) string {
+		return filepath.Join(dir, name)
+	}
+
+	certs, err := meter.LoadCertReloader(file("server.pem"), file("server-key.pem"))
+	AssertNil(t, err)
+	AssertNil(t, certs.Reload())
+	config, err := meter.ServerTLSConfig(certs, file("ca.pem"))
+	AssertNil(t, err)
+	db := &testStore{}
+	var proto int32
+	handler := meter.ClientCertFields("source", meter.StoreHandler(db))
+	srv := http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.StoreInt32(&proto, int32(r.ProtoMajor))
+			handler(w, r)
+		}),
+		TLSConfig: config,
+		ErrorLog:  log.New(ioutil.Discard, "", 0),
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.ServeTLS(ln, "", "")
+	defer srv.Close()
+	url := "https://" + ln.Addr().String()
+
+	s, err := meter.NewTLSHTTPStore(url, file("ca.pem"), file("client.pem"), file("client-key.pem"))
+	AssertNil(t, err)
+	AssertNil(t, s.Store(&meter.StoreRequest{
+		Event:  "foo",
+		Time:   now,
+		Labels: []string{"color", "source"},
+		Counters: meter.Snapshot{
+			{Values: []string{"blue", "spoofed"}, Count: 1},
+			{Values: []string{"red"}, Count: 2},
+		},
+	}))
+	AssertEqual(t, len(db.data), 1)
+	// HTTP/2 is negotiated with client certificates
+	AssertEqual(t, atomic.LoadInt32(&proto), int32(2))
+	AssertEqual(t, db.data[0].Labels, []string{"color", "source"})
+	AssertEqual(t, db.data[0].Counters, meter.Snapshot{
+		{Values: []string{"blue", "collector-1"}, Count: 1},
+		{Values: []string{"red", "collector-1"}, Count: 2},
+	})
+
+	// Clients without a certificate are rejected
+	s, err = meter.NewTLSHTTPStore(url, file("ca.pem"), "", "")
+	AssertNil(t, err)
+	Assert(t, s.Store(&meter.StoreRequest{Event: "foo", Time: now}) != nil, "Client without certificate accepted")
+	_, err = meter.NewTLSHTTPQueryRunner(url, file("missing.pem"), "", "")
+	Assert(t, err != nil, "Missing CA loaded")
+
+	// Reloaded client CAs reject certificates of the old CA
+	roots, err := ioutil.ReadFile(file("ca.pem"))
+	AssertNil(t, err)
+	AssertNil(t, ioutil.WriteFile(file("roots.pem"), roots, 0600))
+	writeTestCert(t, dir, "ca", &x509.Certificate{
+		SerialNumber:          big.NewInt(4),
+		Subject:               pkix.Name{CommonName: "Other CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}, nil, nil)
+	AssertNil(t, certs.Reload())
+	s, err = meter.NewTLSHTTPStore(url, file("roots.pem"), file("client.pem"), file("client-key.pem"))
+	AssertNil(t, err)
+	Assert(t, s.Store(&meter.StoreRequest{Event: "foo", Time: now}) != nil, "Client of old CA accepted")
+}
@@ -0,0 +1,117 @@
+package meter
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"syscall"
+)
+
+// LabelError is the label of the error kind of outbound HTTP requests
+const LabelError = "error"
+
+// Error kinds of outbound HTTP requests
+const (
+	ErrorKindTimeout  = "timeout"
+	ErrorKindDNS      = "dns"
+	ErrorKindRefused  = "refused"
+	ErrorKindCanceled = "canceled"
+	ErrorKindOther    = "other"
+)
+
+// DefaultHTTPClientEvent is the name of events created by NewTransport
+const DefaultHTTPClientEvent = "http_client_requests"
+
+// NewHTTPClientEvent creates an Event with the standard outbound HTTP request labels
+func NewHTTPClientEvent(name string) *Event {
+	return NewEvent(name, LabelHost, LabelMethod, LabelStatus, LabelError)
+}
+
+// Transport is an http.RoundTripper metering outbound requests into an Event
+//
+// Event labels other than the standard labels take their values
+// from the request context fields or EmptyValue.
+// The status of failed requests and the error of successful requests are EmptyValue.
+type Transport struct {
+	Event *Event
+	// Next is the RoundTripper that performs requests, defaults to http.DefaultTransport
+	Next http.RoundTripper
+}
+
+// NewTransport creates a Transport for an Event
+//
+// If e is nil an Event named DefaultHTTPClientEvent with the standard labels is created.
+func NewTransport(e *Event, next http.RoundTripper) *Transport {
+	if e == nil {
+		e = NewHTTPClientEvent(DefaultHTTPClientEvent)
+	}
+	return &Transport{
+		Event: e,
+		Next:  next,
+	}
+}
+
+// RoundTrip implements http.RoundTripper interface
+func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	next := t.Next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	res, err := next.RoundTrip(r)
+	t.record(r, res, err)
+	return res, err
+}
+
+func (t *Transport) record(r *http.Request, res *http.Response, err error) {
+	e := t.Event
+	var buf [8]string
+	values := buf[:0]
+	for _, label := range e.Labels {
+		v := e.EmptyValue
+		switch label {
+		case LabelHost:
+			v = r.URL.Host
+		case LabelMethod:
+			v = r.Method
+			if v == "" {
+				v = http.MethodGet
+			}
+		case LabelStatus:
+			if err == nil && res != nil {
+				v = statusClass(res.StatusCode)
+			}
+		case LabelError:
+			if err != nil {
+				v = errorKind(err)
+			}
+		default:
+			v = e.contextValue(r.Context(), label)
+		}
+		values = append(values, v)
+	}
+	e.Add(1, values...)
+}
+
+// errorKind classifies errors of outbound requests
+func errorKind(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.Canceled):
+		return ErrorKindCanceled
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrorKindTimeout
+	case errors.As(err, &dnsErr):
+		if dnsErr.IsTimeout {
+			return ErrorKindTimeout
+		}
+		return ErrorKindDNS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ErrorKindRefused
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return ErrorKindTimeout
+	default:
+		return ErrorKindOther
+	}
+}
@@ -0,0 +1,56 @@
+package meter_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	meter "github.com/alxarch/go-meter/v2"
+)
+
+func TestTransport(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow":
+			time.Sleep(100 * time.Millisecond)
+		case "/missing":
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	// Grab a free port to get connection refused errors
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused := ln.Addr().String()
+	ln.Close()
+
+	tr := meter.NewTransport(nil, nil)
+	tr.Event.EmptyValue = "-"
+	client := http.Client{Transport: tr}
+	host := srv.Listener.Addr().String()
+	get := func(ctx context.Context, url string) {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if res, err := client.Do(req); err == nil {
+			res.Body.Close()
+		}
+	}
+	ctx := context.Background()
+	get(ctx, srv.URL+"/")
+	get(ctx, srv.URL+"/missing")
+	get(ctx, "http://"+refused+"/")
+	timeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	get(timeout, srv.URL+"/slow")
+
+	AssertSnapshot(t, tr.Event.Flush(nil), meter.Snapshot{
+		{Values: []string{host, "GET", "2xx", "-"}, Count: 1},
+		{Values: []string{host, "GET", "4xx", "-"}, Count: 1},
+		{Values: []string{refused, "GET", "-", "refused"}, Count: 1},
+		{Values: []string{host, "GET", "-", "timeout"}, Count: 1},
+	})
+}
@@ -0,0 +1,276 @@
+package meter
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"time"
+)
+
+// ContentTypeBinary is the content type of the binary encoding of StoreRequests
+const ContentTypeBinary = "application/x-meter-binary"
+
+// Binary encoding of a batch of StoreRequests:
+//
+//	header:  "MTR" version:byte batch:byte count:uvarint request...
+//	request: id:str event:str time:varint kind:byte labels:strs dict:strs count:uvarint counter...
+//	counter: count:varint flags:byte [sum:f64] [min:f64 max:f64 last:f64] values:uvarint(dict index)...
+//
+// Strings are uvarint length prefixed, floats are big endian IEEE 754 bits
+// and time is in nanoseconds since the Unix epoch, zero for zero time.
+const (
+	wireMagic   = "MTR"
+	wireVersion = 1
+)
+
+const (
+	wireFlagSum   = 1 << iota // Counter has a sum
+	wireFlagGauge             // Counter has min, max and last values
+)
+
+var errInvalidBinary = errors.New("Invalid binary data")
+
+// AppendTo appends the binary encoding of a StoreRequest to dst
+func (r *StoreRequest) AppendTo(dst []byte) []byte {
+	dst = appendUvarintString(dst, r.ID)
+	dst = appendUvarintString(dst, r.Event)
+	var ts int64
+	if !r.Time.IsZero() {
+		ts = r.Time.UnixNano()
+	}
+	dst = appendVarint(dst, ts)
+	dst = append(dst, byte(r.Kind))
+	dst = appendUvarint(dst, uint64(len(r.Labels)))
+	for _, label := range r.Labels {
+		dst = appendUvarintString(dst, label)
+	}
+	// Build the value dictionary
+	dict := make(map[string]uint64)
+	var words []string
+	for i := range r.Counters {
+		for _, v := range r.Counters[i].Values {
+			if _, ok := dict[v]; !ok {
+				dict[v] = uint64(len(words))
+				words = append(words, v)
+			}
+		}
+	}
+	dst = appendUvarint(dst, uint64(len(words)))
+	for _, w := range words {
+		dst = appendUvarintString(dst, w)
+	}
+	dst = appendUvarint(dst, uint64(len(r.Counters)))
+	for i := range r.Counters {
+		c := &r.Counters[i]
+		dst = appendVarint(dst, c.Count)
+		var flags byte
+		if c.Sum != 0 {
+			flags |= wireFlagSum
+		}
+		if c.Min != 0 || c.Max != 0 || c.Last != 0 {
+			flags |= wireFlagGauge
+		}
+		dst = append(dst, flags)
+		if flags&wireFlagSum != 0 {
+			dst = appendUint64(dst, math.Float64bits(c.Sum))
+		}
+		if flags&wireFlagGauge != 0 {
+			dst = appendUint64(dst, math.Float64bits(c.Min))
+			dst = appendUint64(dst, math.Float64bits(c.Max))
+			dst = appendUint64(dst, math.Float64bits(c.Last))
+		}
+		dst = appendUvarint(dst, uint64(len(c.Values)))
+		for _, v := range c.Values {
+			dst = appendUvarint(dst, dict[v])
+		}
+	}
+	return dst
+}
+
+// ShiftFrom decodes a StoreRequest from binary data returning the remaining data
+func (r *StoreRequest) ShiftFrom(data []byte) ([]byte, error) {
+	d := wireDecoder{data: data}
+	r.ID = d.string()
+	r.Event = d.string()
+	if ts := d.varint(); ts != 0 {
+		r.Time = time.Unix(0, ts)
+	} else {
+		r.Time = time.Time{}
+	}
+	r.Kind = Kind(d.byte())
+	r.Labels = d.strings(r.Labels[:0])
+	dict := d.strings(nil)
+	n := d.len(1)
+	counters := r.Counters[:0]
+	for i := 0; i < n && d.err == nil; i++ {
+		c := Counter{
+			Count: d.varint(),
+		}
+		flags := d.byte()
+		if flags&wireFlagSum != 0 {
+			c.Sum = d.float()
+		}
+		if flags&wireFlagGauge != 0 {
+			c.Min, c.Max, c.Last = d.float(), d.float(), d.float()
+		}
+		if size := d.len(1); size > 0 {
+			c.Values = make([]string, size)
+			for j := range c.Values {
+				k := d.uvarint()
+				if k >= uint64(len(dict)) {
+					d.fail()
+					break
+				}
+				c.Values[j] = dict[k]
+			}
+		}
+		counters = append(counters, c)
+	}
+	r.Counters = counters
+	return d.data, d.err
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler interface
+func (r *StoreRequest) MarshalBinary() ([]byte, error) {
+	return r.AppendTo(nil), nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler interface
+func (r *StoreRequest) UnmarshalBinary(data []byte) error {
+	tail, err := r.ShiftFrom(data)
+	if err == nil && len(tail) != 0 {
+		err = errInvalidBinary
+	}
+	return err
+}
+
+// appendStoreRequests appends the binary encoding of a batch of StoreRequests to dst
+func appendStoreRequests(dst []byte, batch bool, reqs ...*StoreRequest) []byte {
+	dst = append(dst, wireMagic...)
+	dst = append(dst, wireVersion)
+	if batch {
+		dst = append(dst, 1)
+	} else {
+		dst = append(dst, 0)
+	}
+	dst = appendUvarint(dst, uint64(len(reqs)))
+	for _, r := range reqs {
+		dst = r.AppendTo(dst)
+	}
+	return dst
+}
+
+// decodeStoreRequestsBinary decodes a batch of StoreRequests from binary data
+//
+// It reports whether the data is a batch of requests.
+func decodeStoreRequestsBinary(data []byte) ([]StoreRequest, bool, error) {
+	const headerSize = len(wireMagic) + 2
+	if len(data) < headerSize || string(data[:len(wireMagic)]) != wireMagic || data[len(wireMagic)] != wireVersion {
+		return nil, false, errInvalidBinary
+	}
+	batch := data[len(wireMagic)+1] != 0
+	d := wireDecoder{data: data[headerSize:]}
+	n := d.len(1)
+	if d.err != nil || n == 0 || (!batch && n != 1) {
+		return nil, false, errInvalidBinary
+	}
+	reqs := make([]StoreRequest, n)
+	data = d.data
+	for i := range reqs {
+		var err error
+		if data, err = reqs[i].ShiftFrom(data); err != nil {
+			return nil, false, err
+		}
+	}
+	if len(data) != 0 {
+		return nil, false, errInvalidBinary
+	}
+	return reqs, batch, nil
+}
+
+func appendUvarintString(dst []byte, s string) []byte {
+	dst = appendUvarint(dst, uint64(len(s)))
+	return append(dst, s...)
+}
+
+// wireDecoder decodes binary data keeping the first error
+type wireDecoder struct {
+	data []byte
+	err  error
+}
+
+func (d *wireDecoder) fail() {
+	if d.err == nil {
+		d.err = errInvalidBinary
+	}
+	d.data = nil
+}
+
+func (d *wireDecoder) uvarint() uint64 {
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.fail()
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *wireDecoder) varint() int64 {
+	v, n := binary.Varint(d.data)
+	if n <= 0 {
+		d.fail()
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+// len decodes a length of items of at least minSize bytes each
+func (d *wireDecoder) len(minSize int) int {
+	n := d.uvarint()
+	if n > uint64(len(d.data)/minSize) {
+		d.fail()
+		return 0
+	}
+	return int(n)
+}
+
+func (d *wireDecoder) byte() byte {
+	if len(d.data) < 1 {
+		d.fail()
+		return 0
+	}
+	b := d.data[0]
+	d.data = d.data[1:]
+	return b
+}
+
+func (d *wireDecoder) float() float64 {
+	if len(d.data) < 8 {
+		d.fail()
+		return 0
+	}
+	var u uint64
+	u, d.data = shiftUint64(d.data)
+	return math.Float64frombits(u)
+}
+
+func (d *wireDecoder) string() string {
+	n := d.uvarint()
+	if n > uint64(len(d.data)) {
+		d.fail()
+		return ""
+	}
+	s := string(d.data[:n])
+	d.data = d.data[n:]
+	return s
+}
+
+func (d *wireDecoder) strings(dst []string) []string {
+	n := d.len(1)
+	for i := 0; i < n && d.err == nil; i++ {
+		dst = append(dst, d.string())
+	}
+	return dst
+}
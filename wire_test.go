@@ -0,0 +1,137 @@
+package meter_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	meter "github.com/alxarch/go-meter/v2"
+)
+
+func testWireRequest(size int) *meter.StoreRequest {
+	colors := []string{"red", "green", "blue", "yellow", "black"}
+	tastes := []string{"sweet", "sour", "bitter", "salty"}
+	req := meter.StoreRequest{
+		Event:  "foo",
+		Time:   time.Unix(1562222400, 0),
+		Labels: []string{"color", "taste", "id"},
+		Kind:   meter.GaugeKind,
+	}
+	for i := 0; i < size; i++ {
+		req.Counters = append(req.Counters, meter.Counter{
+			Values: []string{colors[i%len(colors)], tastes[i%len(tastes)], strconv.Itoa(i % 50)},
+			Count:  int64(i + 1),
+			Sum:    float64(i) * 1.5,
+			Min:    0.5,
+			Max:    float64(i),
+			Last:   1,
+		})
+	}
+	return &req
+}
+
+func TestStoreRequest_MarshalBinary(t *testing.T) {
+	req := testWireRequest(100)
+	req.Counters = append(req.Counters, meter.Counter{Count: -1})
+	data, err := req.MarshalBinary()
+	AssertNil(t, err)
+	out := meter.StoreRequest{}
+	AssertNil(t, out.UnmarshalBinary(data))
+	Assert(t, out.Time.Equal(req.Time), "Invalid time %s", out.Time)
+	out.Time = req.Time
+	AssertEqual(t, &out, req)
+	for i := range data {
+		Assert(t, out.UnmarshalBinary(data[:i]) != nil, "Truncated data decoded %d", i)
+	}
+	json, _ := json.Marshal(req)
+	t.Logf("Binary size %d JSON size %d", len(data), len(json))
+}
+
+func BenchmarkStoreRequest_JSONGzip(b *testing.B) {
+	req := testWireRequest(500)
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	enc := json.NewEncoder(zw)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		zw.Reset(&buf)
+		enc.Encode(req)
+		zw.Close()
+	}
+	b.ReportMetric(float64(buf.Len()), "bytes")
+}
+
+func BenchmarkStoreRequest_Binary(b *testing.B) {
+	req := testWireRequest(500)
+	var data []byte
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		data = req.AppendTo(data[:0])
+	}
+	b.ReportMetric(float64(len(data)), "bytes")
+}
+
+func BenchmarkStoreRequest_BinaryGzip(b *testing.B) {
+	req := testWireRequest(500)
+	var data []byte
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		data = req.AppendTo(data[:0])
+		buf.Reset()
+		zw.Reset(&buf)
+		zw.Write(data)
+		zw.Close()
+	}
+	b.ReportMetric(float64(buf.Len()), "bytes")
+}
+
+func BenchmarkStoreRequest_UnmarshalJSON(b *testing.B) {
+	data, _ := json.Marshal(testWireRequest(500))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		req := meter.StoreRequest{}
+		json.Unmarshal(data, &req)
+	}
+}
+
+func BenchmarkStoreRequest_UnmarshalBinary(b *testing.B) {
+	data, _ := testWireRequest(500).MarshalBinary()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		req := meter.StoreRequest{}
+		req.UnmarshalBinary(data)
+	}
+}
+
+func TestHTTPStore_Binary(t *testing.T) {
+	db := &testStore{}
+	srv := httptest.NewServer(meter.StoreHandler(db))
+	defer srv.Close()
+	s := &meter.HTTPStore{
+		URL:    srv.URL,
+		Binary: true,
+	}
+	req := testWireRequest(10)
+	AssertNil(t, s.Store(req))
+	s.Batch = time.Millisecond
+	AssertNil(t, s.Store(req))
+	AssertEqual(t, len(db.data), 2)
+	for i := range db.data {
+		AssertEqual(t, db.data[i].Counters, req.Counters)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("MTR\x01\x00\x05"))
+	r.Header.Set("Content-Type", meter.ContentTypeBinary)
+	w := httptest.NewRecorder()
+	meter.StoreHandler(db)(w, r)
+	AssertEqual(t, w.Code, http.StatusBadRequest)
+}